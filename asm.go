@@ -0,0 +1,160 @@
+package forky
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+)
+
+// asmSymbol matches a symbol reference in a Go assembly file: an optional package path, written
+// with "∕" in place of "/" and optionally "·" in place of ".", followed by "·" and the name of the
+// symbol (e.g. math∕big·addVV or github·com∕dave∕golib·f). The package path is everything up to the
+// last "·".
+var asmSymbol = regexp.MustCompile(`([\p{L}\p{N}_.∕·]*)·([\p{L}\p{N}_]+)`)
+
+// asmName matches the name of a symbol in a Go assembly file.
+var asmName = regexp.MustCompile(`·([\p{L}\p{N}_]+)`)
+
+// replaceAsmPaths calls replace for the package path of every qualified symbol in an assembly
+// file, and returns the updated contents.
+func replaceAsmPaths(contents []byte, replace func(path string) string) []byte {
+	return asmSymbol.ReplaceAllFunc(contents, func(b []byte) []byte {
+		match := asmSymbol.FindSubmatch(b)
+		if len(match[1]) == 0 {
+			// reference to a symbol in the same package
+			return b
+		}
+		p := strings.NewReplacer("∕", "/", "·", ".").Replace(string(match[1]))
+		p = strings.NewReplacer("/", "∕", ".", "·").Replace(replace(p))
+		return []byte(p + "·" + string(match[2]))
+	})
+}
+
+// asmFunc is a Go function declaration without a body, in a package that has assembly files.
+type asmFunc struct {
+	relpath, pkg, fname string
+	recv, name          string // name of the receiver type (if any) and the function
+	signature           string
+	decl                *dst.FuncDecl
+}
+
+// key identifies an assembly backed function in the session.
+func (f asmFunc) key() string {
+	return path.Join(f.relpath, f.pkg) + " " + f.recv + "." + f.name
+}
+
+// asmFuncs returns all assembly backed functions in the session.
+func (s *Session) asmFuncs() []asmFunc {
+	var funcs []asmFunc
+	for _, relpath := range s.relpaths() {
+		info := s.paths[relpath]
+		var asm bool
+		for fname := range info.Extras {
+			if strings.HasSuffix(fname, ".s") {
+				asm = true
+				break
+			}
+		}
+		if !asm {
+			continue
+		}
+		for pkgname, pkg := range info.Packages {
+			for fname, file := range pkg.Files {
+				if file == nil {
+					continue
+				}
+				for _, decl := range file.Decls {
+					fd, ok := decl.(*dst.FuncDecl)
+					if !ok || fd.Body != nil {
+						continue
+					}
+					funcs = append(funcs, asmFunc{
+						relpath:   relpath,
+						pkg:       pkgname,
+						fname:     fname,
+						recv:      receiverName(fd),
+						name:      fd.Name.Name,
+						signature: s.signature(relpath, file, fd),
+						decl:      fd,
+					})
+				}
+			}
+		}
+	}
+	return funcs
+}
+
+// checkAsm reports assembly backed functions that have had their signature changed since the
+// last check, because the assembly would no longer match. Functions that have been turned into
+// methods (e.g. by Libify) are matched by name.
+func (s *Session) checkAsm(before []asmFunc) []asmFunc {
+	after := s.asmFuncs()
+	current := map[string]asmFunc{}
+	byName := map[string][]asmFunc{}
+	for _, f := range after {
+		current[f.key()] = f
+		name := path.Join(f.relpath, f.pkg) + " " + f.name
+		byName[name] = append(byName[name], f)
+	}
+	// funcs that have been deleted or given a body are not reported
+	for _, f := range before {
+		g, ok := current[f.key()]
+		if !ok {
+			candidates := byName[path.Join(f.relpath, f.pkg)+" "+f.name]
+			if len(candidates) != 1 {
+				continue
+			}
+			g = candidates[0]
+		}
+		if g.signature == f.signature {
+			continue
+		}
+		s.report(&Error{
+			Pos: s.nodePosition(g.relpath, g.fname, g.decl),
+			Err: fmt.Errorf("signature of assembly function changed from %s to %s", f.signature, g.signature),
+		})
+	}
+	return after
+}
+
+// signature returns the receiver, name, parameters and results of a function declaration as
+// source.
+func (s *Session) signature(relpath string, file *dst.File, fd *dst.FuncDecl) string {
+	decl := &dst.FuncDecl{Recv: fd.Recv, Name: fd.Name, Type: fd.Type}
+	f := &dst.File{Name: file.Name, Decls: []dst.Decl{decl}}
+	buf := &bytes.Buffer{}
+	var err error
+	if s.managed[file] {
+		err = s.restorer(relpath).Fprint(buf, f)
+	} else {
+		err = decorator.Fprint(buf, f)
+	}
+	if err != nil {
+		return ""
+	}
+	b := buf.Bytes()
+	// drop the package clause and any imports
+	if i := bytes.Index(b, []byte("\nfunc ")); i > -1 {
+		b = b[i+1:]
+	}
+	return string(bytes.TrimSpace(b))
+}
+
+func receiverName(fd *dst.FuncDecl) string {
+	if fd.Recv == nil || len(fd.Recv.List) == 0 {
+		return ""
+	}
+	t := fd.Recv.List[0].Type
+	if star, ok := t.(*dst.StarExpr); ok {
+		t = star.X
+	}
+	if id, ok := t.(*dst.Ident); ok {
+		return id.Name
+	}
+	return ""
+}
@@ -0,0 +1,68 @@
+package forky
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/dstutil"
+)
+
+func TestAsm(t *testing.T) {
+	files := map[string]string{
+		"a/a.go":       "package a\n\nfunc add(x, y int) int\n\nfunc sub(x, y int) int\n",
+		"a/a_amd64.s":  "TEXT ·add(SB),0,$0\n\tCALL foo∕bar·baz(SB)\n\tCALL foo∕barbaz·qux(SB)\n\tRET\n",
+		"b/b.go":       "package b\n\nfunc f(x int)\n",
+		"b/b_amd64.go": "package b\n",
+	}
+	s := newTestSession(t, files)
+	err := s.Run([]Mutator{
+		&PathReplacer{
+			Matchers:    []string{"foo/bar"},
+			Replacement: "${1}qux/${2}${3}",
+		},
+		// changes the type of the first param of add and f
+		Manual(func(relpath, fname string) func(c *dstutil.Cursor) bool {
+			return func(c *dstutil.Cursor) bool {
+				if fd, ok := c.Node().(*dst.FuncDecl); ok && fd.Body == nil && (fd.Name.Name == "add" || fd.Name.Name == "f") {
+					fd.Type.Params.List[0].Type = dst.NewIdent("int64")
+				}
+				return true
+			}
+		}),
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	list := err.(ErrorList)
+	if len(list) != 1 || !strings.HasPrefix(list[0].Error(), "/a/a.go:3:1: forky.Manual: signature of assembly function changed from func add(x, y int) int to func add(x, y int64) int") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	found, err := readFile(s.fs, "/out/a/a_amd64.s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "TEXT ·add(SB),0,$0\n\tCALL qux∕foo∕bar·baz(SB)\n\tCALL foo∕barbaz·qux(SB)\n\tRET\n"
+	if string(found) != expected {
+		t.Fatalf("unexpected a_amd64.s:\n%s", string(found))
+	}
+
+	// periods in the path are written as "·"
+	replaced := replaceAsmPaths([]byte("CALL foo∕bar·baz(SB)\nCALL github·com∕a∕b·f(SB)\nCALL ·g(SB)\n"), func(p string) string {
+		switch p {
+		case "foo/bar":
+			return "github.com/dave/golib/foo/bar"
+		case "github.com/a/b":
+			return "c/d"
+		}
+		return p
+	})
+	expected = "CALL github·com∕dave∕golib∕foo∕bar·baz(SB)\nCALL c∕d·f(SB)\nCALL ·g(SB)\n"
+	if string(replaced) != expected {
+		t.Fatalf("expected %q, found %q", expected, replaced)
+	}
+}
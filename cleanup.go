@@ -0,0 +1,115 @@
+package forky
+
+import (
+	"go/types"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/dave/dst"
+	"golang.org/x/tools/go/packages"
+)
+
+// Cleanup removes the imports that are no longer used after files or declarations have been deleted
+// (e.g. by FilterFiles, DeleteNodes or Libify), so the output compiles. The unused imports are found
+// from the type information of the packages and their tests, for each of the Platforms (or the host
+// platform if there are none). If Declarations is set, it also deletes the unexported package level
+// declarations that are no longer referenced (see DeadCode) on the host platform. Set
+// Session.AutoCleanup to run it at the end of every Run.
+type Cleanup struct {
+	Declarations bool
+	Platforms    []Platform
+}
+
+func (m Cleanup) Apply(s *Session) Applier {
+	return Applier{
+		Func: func() {
+			s.cleanup(m)
+		},
+	}
+}
+
+func (s *Session) cleanup(m Cleanup) {
+	platforms := m.Platforms
+	if len(platforms) == 0 {
+		platforms = []Platform{{}}
+	}
+	for _, p := range platforms {
+		_, pkgs, err := s.typecheck(p, true)
+		if _, ok := err.(ErrorList); ok && s.removeUnusedImportsFrom(pkgs) {
+			_, _, err = s.typecheck(p, true)
+		}
+		if err != nil {
+			s.report(err)
+			return
+		}
+	}
+	if m.Declarations {
+		if err := s.load(); err != nil {
+			s.report(err)
+			return
+		}
+		s.typed = true
+		s.deadCode(DeadCode{Packages: []string{".", "**"}, Exported: []string{".", "**"}})
+	}
+}
+
+// removeUnusedImportsFrom removes the imports whose package name isn't used in the type information
+// of the loaded packages from the files of the session, and returns true if any were removed.
+func (s *Session) removeUnusedImportsFrom(pkgs []*packages.Package) bool {
+	var found bool
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		pkgpath := pkg.PkgPath
+		if strings.HasSuffix(pkg.Name, "_test") {
+			// external test package
+			pkgpath = strings.TrimSuffix(pkgpath, "_test")
+		}
+		relpath, ok := s.Rel(pkgpath)
+		if !ok || pkg.TypesInfo == nil || s.paths[relpath] == nil || s.paths[relpath].Packages[pkg.Name] == nil {
+			return
+		}
+		used := map[*types.PkgName]bool{}
+		for _, ob := range pkg.TypesInfo.Uses {
+			if pn, ok := ob.(*types.PkgName); ok {
+				used[pn] = true
+			}
+		}
+		for _, f := range pkg.Syntax {
+			unused := map[*types.PkgName]bool{}
+			for _, spec := range f.Imports {
+				if spec.Name != nil && (spec.Name.Name == "_" || spec.Name.Name == ".") || spec.Path.Value == `"C"` {
+					continue
+				}
+				ob := pkg.TypesInfo.Implicits[spec]
+				if spec.Name != nil {
+					ob = pkg.TypesInfo.Defs[spec.Name]
+				}
+				if pn, ok := ob.(*types.PkgName); ok && !used[pn] {
+					unused[pn] = true
+				}
+			}
+			if len(unused) == 0 {
+				continue
+			}
+			_, fname := filepath.Split(s.fset.File(f.Pos()).Name())
+			file := s.paths[relpath].Packages[pkg.Name].Files[fname]
+			if file == nil {
+				continue
+			}
+			removeImports(file, func(is *dst.ImportSpec) bool {
+				p, err := strconv.Unquote(is.Path.Value)
+				if err != nil {
+					return true
+				}
+				for pn := range unused {
+					if pn.Imported().Path() == p && (is.Name == nil || is.Name.Name == pn.Name()) {
+						found = true
+						return false
+					}
+				}
+				return true
+			})
+		}
+	})
+	return found
+}
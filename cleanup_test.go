@@ -0,0 +1,90 @@
+package forky
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dave/dst"
+)
+
+func TestCleanup(t *testing.T) {
+	files := map[string]string{
+		"a/a.go": `package a
+
+import (
+	"fmt"
+	str "strings"
+	"unicode"
+	_ "unsafe"
+)
+
+func F() { fmt.Println() }
+
+func G() { helper(); str.ToUpper(""); unicode.IsUpper('a') }
+
+func helper() {}
+
+func Kept() {}
+
+func unused() {}
+`,
+		"a/b.go":         "package a\n\nimport \"unicode\"\n\nvar U = unicode.IsUpper\n",
+		"a/a_test.go":    "package a_test\n\nimport (\n\t\"strings\"\n\t\"testing\"\n)\n\nfunc G() { strings.ToUpper(\"\") }\n\nfunc TestF(t *testing.T) {}\n",
+		"a/a_windows.go": "package a\n\nimport \"strings\"\n\nfunc H() { strings.ToUpper(\"\") }\n",
+	}
+	// deletes G and H, so strings and unicode (in a.go), and strings in the other files are no
+	// longer used, and helper isn't referenced
+	deleteG := DeleteNodes(func(relpath, fname string, node, parent dst.Node) bool {
+		fd, ok := node.(*dst.FuncDecl)
+		return ok && (fd.Name.Name == "G" || fd.Name.Name == "H")
+	})
+	run := func(auto *Cleanup, mutators ...Mutator) *Session {
+		s := newTestSession(t, files)
+		s.AutoCleanup = auto
+		if err := s.Run(mutators); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	imports := func(s *Session, pkg, fname string) bool {
+		return strings.Contains(string(s.printFile("a", s.paths["a"].Packages[pkg].Files[fname])), `"strings"`)
+	}
+	check := func(s *Session, kept, deleted []string) {
+		t.Helper()
+		found := string(s.printFile("a", s.paths["a"].Packages["a"].Files["a.go"]))
+		for _, c := range kept {
+			if !strings.Contains(found, c) {
+				t.Fatalf("a.go should contain %q:\n%s", c, found)
+			}
+		}
+		for _, c := range deleted {
+			if strings.Contains(found, c) {
+				t.Fatalf("a.go should not contain %q:\n%s", c, found)
+			}
+		}
+	}
+
+	s := run(nil, deleteG, Cleanup{})
+	check(s, []string{`"fmt"`, `_ "unsafe"`, "func helper()", "func unused()"}, []string{`"strings"`, `"unicode"`})
+	if !strings.Contains(string(s.printFile("a", s.paths["a"].Packages["a"].Files["b.go"])), `"unicode"`) {
+		t.Fatal("b.go should still import unicode")
+	}
+	if imports(s, "a_test", "a_test.go") {
+		t.Fatal("a_test.go should not import strings")
+	}
+	// only the host platform is checked by default
+	if !imports(s, "a", "a_windows.go") {
+		t.Fatal("a_windows.go should still import strings")
+	}
+
+	s = run(nil, deleteG, Cleanup{Platforms: []Platform{{}, {GOOS: "windows", GOARCH: "amd64"}}})
+	if imports(s, "a", "a_windows.go") {
+		t.Fatal("a_windows.go should not import strings")
+	}
+
+	s = run(&Cleanup{Declarations: true}, deleteG)
+	check(s, []string{`"fmt"`, "func F()", "func Kept()"}, []string{`"strings"`, `"unicode"`, "func helper()", "func unused()"})
+	if len(s.applied) != 2 || s.applied[1] != "forky.Cleanup" {
+		t.Fatalf("expected cleanup to be applied, found %v", s.applied)
+	}
+}
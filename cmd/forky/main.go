@@ -0,0 +1,241 @@
+// Command forky runs the fork described by a config file (see forky.Config).
+//
+//	forky run [flags] forky.yaml    apply the mutators and save the output
+//	forky diff [flags] forky.yaml   apply the mutators and print a diff of the changes
+//	forky stats [flags] forky.yaml  apply the mutators and print the number of files changed by each
+//	forky skips [flags] forky.yaml [packages]
+//	                                test the output and print a skip_tests list of the failed tests
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/build"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/dave/forky"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+const usage = `usage: forky <command> [flags] <config file>
+
+commands:
+	run     apply the mutators and save the output
+	diff    apply the mutators and print a diff of the changes
+	stats   apply the mutators and print the number of files changed by each
+	skips   apply the mutators (apart from skip_tests), save the output to a scratch dir, run go test
+	        on the packages (relpaths in the destination, default ./...) and print a skip_tests list
+	        of the failed tests, and how it differs from the skip_tests in the config
+
+flags:
+`
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	flags := flag.NewFlagSet("forky", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	jsonEvents := flags.Bool("json", false, "write progress and events to stderr as JSON lines")
+	revision := flags.String("rev", "", "read the source from this git revision of the source dir (overrides the config)")
+	branch := flags.String("branch", "", "run: save the output as a commit on this branch of the destination git repository")
+	author := flags.String("author", "forky <forky@localhost>", "run: author of the commit when saving to a branch")
+	force := flags.Bool("force", false, "run: overwrite files in the destination that weren't created by forky, or commit to the checked out branch")
+	format := flags.String("format", "yaml", "skips: format of the skip list (yaml or go)")
+
+	if len(args) < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	command := args[0]
+	switch command {
+	case "run", "diff", "stats", "skips":
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+	flags.Parse(args[1:])
+	if flags.NArg() < 1 || flags.NArg() > 1 && command != "skips" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if command == "skips" {
+		// check the format before running the mutators and the tests
+		if err := forky.WriteTestSkips(ioutil.Discard, nil, *format); err != nil {
+			return err
+		}
+	}
+
+	config, err := forky.LoadConfig(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *revision != "" {
+		config.Revision = *revision
+	}
+	if *force {
+		config.Force = true
+	}
+	var existing []forky.TestSkip
+	if command == "skips" {
+		// the tests are run without the skips, so they can be compared to the failures
+		var mutators []forky.MutatorConfig
+		for _, mc := range config.Mutators {
+			if mc.SkipTests == nil {
+				mutators = append(mutators, mc)
+				continue
+			}
+			for _, ts := range mc.SkipTests {
+				existing = append(existing, forky.TestSkip{Path: ts.Path, Name: ts.Name, Comment: ts.Comment, Regexp: ts.Regexp})
+			}
+		}
+		config.Mutators = mutators
+	}
+	mutators, err := config.Build()
+	if err != nil {
+		return err
+	}
+	s, err := config.Session()
+	if err != nil {
+		return err
+	}
+
+	var progress forky.Observer = forky.NewTextObserver(os.Stderr)
+	if *jsonEvents {
+		progress = forky.NewJSONObserver(os.Stderr)
+	}
+	changes := &changeCounter{Observer: progress}
+	s.Observer = changes
+
+	if err := s.Run(mutators); err != nil {
+		return err
+	}
+
+	switch command {
+	case "diff":
+		return s.Diff(os.Stdout)
+	case "stats":
+		printStats(os.Stdout, s.Stats(), changes.changes)
+		return nil
+	case "skips":
+		return skips(s, config, existing, flags.Args()[1:], *format)
+	}
+
+	if *branch != "" {
+		sig := object.Signature{}
+		sig.Decode([]byte(*author))
+		repo := config.Outdir
+		if repo == "" {
+			repo = filepath.Join(build.Default.GOPATH, "src", config.Destination)
+		}
+		hash, err := s.SaveGit(repo, *branch, sig)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("saved %s to %s\n", hash, *branch)
+		return nil
+	}
+	return s.Save()
+}
+
+// skips tests the output in a scratch dir, and prints the skips for the failed tests.
+func skips(s *forky.Session, config *forky.Config, existing []forky.TestSkip, packages []string, format string) error {
+	scratch, err := ioutil.TempDir("", "forky-skips")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratch)
+
+	env := os.Environ()
+	dir := scratch
+	if !config.Module {
+		dir = filepath.Join(scratch, "src", config.Destination)
+		// packages outside the destination are still found in the GOPATH
+		env = append(env, "GOPATH="+scratch+string(os.PathListSeparator)+build.Default.GOPATH, "GO111MODULE=off")
+	}
+	if err := s.SaveTo(dir); err != nil {
+		return err
+	}
+
+	args := []string{"test", "-json"}
+	if len(packages) == 0 {
+		packages = []string{"..."}
+	}
+	for _, p := range packages {
+		args = append(args, "./"+path.Clean(p))
+	}
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		// go test exits with an error when tests fail
+		return err
+	}
+
+	failures, failedPackages, err := s.TestFailures(bytes.NewReader(out))
+	if err != nil {
+		return err
+	}
+	if err := forky.WriteTestSkips(os.Stdout, failures, format); err != nil {
+		return err
+	}
+	added, stale, err := forky.DiffTestSkips(existing, failures)
+	if err != nil {
+		return err
+	}
+	for _, ts := range added {
+		fmt.Fprintf(os.Stderr, "new failure: %s %s: %s\n", ts.Path, ts.Name, ts.Comment)
+	}
+	for _, ts := range stale {
+		fmt.Fprintf(os.Stderr, "stale skip: %s %s\n", ts.Path, ts.Name)
+	}
+	for _, relpath := range failedPackages {
+		fmt.Fprintf(os.Stderr, "package failed: %s\n", relpath)
+	}
+	return nil
+}
+
+// changeCounter records the number of files changed by each mutator.
+type changeCounter struct {
+	forky.Observer
+	changes []change
+}
+
+type change struct {
+	mutator string
+	files   int
+}
+
+func (c *changeCounter) Changed(mutator string, files int) {
+	c.changes = append(c.changes, change{mutator, files})
+	c.Observer.Changed(mutator, files)
+}
+
+func printStats(w io.Writer, st forky.Stats, changes []change) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "dirs\t%d\n", st.Dirs)
+	fmt.Fprintf(tw, "packages\t%d\n", st.Packages)
+	fmt.Fprintf(tw, "go files\t%d\n", st.Files)
+	fmt.Fprintf(tw, "other files\t%d\n", st.Extras)
+	fmt.Fprintln(tw)
+	for _, c := range changes {
+		fmt.Fprintf(tw, "%s\t%d files changed\n", c.mutator, c.files)
+	}
+	tw.Flush()
+}
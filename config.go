@@ -0,0 +1,346 @@
+package forky
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dave/dst"
+	"gopkg.in/yaml.v2"
+)
+
+// Config describes a fork: where the source is read from, where the output is written and the
+// mutators to apply, in order. It's read from a YAML file (JSON is also accepted), e.g.:
+//
+//	dir: ../go
+//	source: go.googlesource.com/go
+//	destination: github.com/dave/golib
+//	parse:
+//	  include: [src/**]
+//	  exclude: ["**/testdata", "**/testdata/**"]
+//	mutators:
+//	  - keep_deps:
+//	      roots: [src/cmd/compile]
+//	      src_dirs: [src]
+//	      scope: [src/cmd/**]
+//	  - replace_paths:
+//	      matchers: [cmd/compile, cmd/internal]
+//	      replacement: ${1}github.com/dave/golib/src/${2}${3}
+//	      extras: ["*.go", "*.s"]
+//	  - skip_tests:
+//	      - {path: src/cmd/link, name: TestDWARF, comment: "TODO: ???", expect: {min: 1}}
+//	  - libify:
+//	      packages: [src/cmd/compile]
+//	      platforms: [linux/amd64, darwin/amd64]
+type Config struct {
+	Dir         string          `yaml:"dir"`         // source dir, relative to the config file
+	Source      string          `yaml:"source"`      // root path of the source (GOPATH mode)
+	Destination string          `yaml:"destination"` // root path of the destination
+	Module      bool            `yaml:"module"`      // the source is a go module (see NewModuleSession)
+	Outdir      string          `yaml:"outdir"`      // output dir (module mode), relative to the config file
+	Revision    string          `yaml:"revision"`    // read the source from this git revision of dir (see ReadGit)
+	Workers     int             `yaml:"workers"`
+	Force       bool            `yaml:"force"`
+	WarnStale   bool            `yaml:"warn_stale"` // report unmet expectations as warnings rather than errors
+	Cleanup     *CleanupConfig  `yaml:"cleanup"`    // cleanup after the mutators (see Session.AutoCleanup)
+	Parse       *PathFilter     `yaml:"parse"`      // dirs to parse
+	Mutators    []MutatorConfig `yaml:"mutators"`
+}
+
+// PathFilter matches dirs that match any of the Include specs (or all dirs if there are none),
+// and none of the Exclude specs. Specs are as in MatchPath.
+type PathFilter struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+func (f *PathFilter) Match(relpath string) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Include) > 0 && !MatchPath(relpath, f.Include...) {
+		return false
+	}
+	return !MatchPath(relpath, f.Exclude...)
+}
+
+// MutatorConfig is an item in the mutators list. Exactly one of the fields must be set, apart
+// from Expect (see Expecting).
+type MutatorConfig struct {
+	Expect       *Expect             `yaml:"expect"`
+	Filter       *FilterConfig       `yaml:"filter"`
+	KeepDeps     *KeepDepsConfig     `yaml:"keep_deps"`
+	ReplacePaths *ReplacePathsConfig `yaml:"replace_paths"`
+	SkipTests    []TestSkipConfig    `yaml:"skip_tests"`
+	Libify       *LibifyConfig       `yaml:"libify"`
+	DeadCode     *DeadCodeConfig     `yaml:"dead_code"`
+	Constraints  *ConstraintsConfig  `yaml:"build_constraints"`
+	Cleanup      *CleanupConfig      `yaml:"cleanup"`
+}
+
+// FilterConfig deletes the files in dirs that don't match Keep, or match Delete (see FilterFiles).
+type FilterConfig struct {
+	Keep   []string `yaml:"keep"`
+	Delete []string `yaml:"delete"`
+}
+
+// KeepDepsConfig configures KeepDeps. Platforms are written GOOS/GOARCH.
+type KeepDepsConfig struct {
+	Roots     []string `yaml:"roots"`
+	SrcDirs   []string `yaml:"src_dirs"`
+	Scope     []string `yaml:"scope"`
+	Keep      []string `yaml:"keep"`
+	Platforms []string `yaml:"platforms"`
+}
+
+// ReplacePathsConfig configures a PathReplacer. Extras is a list of file name patterns (as in
+// path.Match) of the extras to replace paths in. Literals is a list of MatchPath specs of the go
+// files (e.g. src/cmd/go/**/*_test.go) to replace paths in all string literals in if Imports is set.
+type ReplacePathsConfig struct {
+	Matchers    []string `yaml:"matchers"`
+	Replacement string   `yaml:"replacement"`
+	Extras      []string `yaml:"extras"`
+	Imports     bool     `yaml:"imports"`
+	Literals    []string `yaml:"literals"`
+}
+
+type TestSkipConfig struct {
+	Path    string  `yaml:"path"`
+	Name    string  `yaml:"name"`
+	Comment string  `yaml:"comment"`
+	Regexp  bool    `yaml:"regexp"`
+	Expect  *Expect `yaml:"expect"`
+}
+
+// LibifyConfig configures Libify. Platforms are written GOOS/GOARCH.
+type LibifyConfig struct {
+	Packages  []string `yaml:"packages"`
+	Platforms []string `yaml:"platforms"`
+}
+
+// DeadCodeConfig configures DeadCode.
+type DeadCodeConfig struct {
+	Packages  []string `yaml:"packages"`
+	Exported  []string `yaml:"exported"`
+	Used      []string `yaml:"used"`
+	DropTests bool     `yaml:"drop_tests"`
+}
+
+// CleanupConfig configures Cleanup. Platforms are written GOOS/GOARCH.
+type CleanupConfig struct {
+	Declarations bool     `yaml:"declarations"`
+	Platforms    []string `yaml:"platforms"`
+}
+
+// Build returns the Cleanup for the config.
+func (cc CleanupConfig) Build() (Cleanup, error) {
+	platforms, err := parsePlatforms(cc.Platforms)
+	if err != nil {
+		return Cleanup{}, fmt.Errorf("cleanup: %v", err)
+	}
+	return Cleanup{Declarations: cc.Declarations, Platforms: platforms}, nil
+}
+
+// ConstraintsConfig configures BuildConstraints. Platforms are written GOOS/GOARCH, and Action is
+// drop (the default), extras or ignore.
+type ConstraintsConfig struct {
+	Platforms []string `yaml:"platforms"`
+	Tags      []string `yaml:"tags"`
+	Action    string   `yaml:"action"`
+}
+
+// LoadConfig reads a config file. Relative dirs in the config are resolved relative to the dir of
+// the config file.
+func LoadConfig(fpath string) (*Config, error) {
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, fmt.Errorf("%s: %v", fpath, err)
+	}
+	base := filepath.Dir(fpath)
+	if c.Dir != "" && !filepath.IsAbs(c.Dir) {
+		c.Dir = filepath.Join(base, c.Dir)
+	}
+	if c.Outdir != "" && !filepath.IsAbs(c.Outdir) {
+		c.Outdir = filepath.Join(base, c.Outdir)
+	}
+	if _, err := c.Build(); err != nil {
+		return nil, fmt.Errorf("%s: %v", fpath, err)
+	}
+	return c, nil
+}
+
+// Session creates a session for the config.
+func (c *Config) Session() (*Session, error) {
+	if c.Dir == "" {
+		return nil, errors.New("dir not set")
+	}
+	var s *Session
+	if c.Module {
+		s = NewModuleSession(c.Dir, c.Outdir, c.Destination)
+	} else {
+		s = NewSession(c.Dir, c.Source, c.Destination)
+	}
+	if c.Workers > 0 {
+		s.Workers = c.Workers
+	}
+	s.Force = c.Force
+	s.WarnStale = c.WarnStale
+	if c.Cleanup != nil {
+		m, err := c.Cleanup.Build()
+		if err != nil {
+			return nil, err
+		}
+		s.AutoCleanup = &m
+	}
+	if c.Parse != nil {
+		s.ParseFilter = func(relpath string, file os.FileInfo) bool {
+			return c.Parse.Match(relpath)
+		}
+	}
+	if c.Revision != "" {
+		if err := s.ReadGit(c.Dir, c.Revision); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Build returns the mutators in the config.
+func (c *Config) Build() ([]Mutator, error) {
+	var mutators []Mutator
+	for i, mc := range c.Mutators {
+		m, err := mc.Build()
+		if err != nil {
+			return nil, fmt.Errorf("mutator %d: %v", i+1, err)
+		}
+		mutators = append(mutators, m)
+	}
+	return mutators, nil
+}
+
+func (mc MutatorConfig) Build() (Mutator, error) {
+	var mutators []Mutator
+	if mc.Filter != nil {
+		f := mc.Filter
+		mutators = append(mutators, FilterFiles(func(relpath, fname string) bool {
+			if len(f.Keep) > 0 && !MatchPath(relpath, f.Keep...) {
+				return false
+			}
+			return !MatchPath(relpath, f.Delete...)
+		}))
+	}
+	if mc.KeepDeps != nil {
+		kd := mc.KeepDeps
+		platforms, err := parsePlatforms(kd.Platforms)
+		if err != nil {
+			return nil, fmt.Errorf("keep_deps: %v", err)
+		}
+		mutators = append(mutators, KeepDeps{
+			Roots:     kd.Roots,
+			SrcDirs:   kd.SrcDirs,
+			Scope:     kd.Scope,
+			Keep:      kd.Keep,
+			Platforms: platforms,
+		})
+	}
+	if mc.ReplacePaths != nil {
+		rp := mc.ReplacePaths
+		for _, pattern := range rp.Extras {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("replace_paths: bad extras pattern %q", pattern)
+			}
+		}
+		m := &PathReplacer{
+			Matchers:    rp.Matchers,
+			Replacement: rp.Replacement,
+			Imports:     rp.Imports,
+		}
+		if len(rp.Literals) > 0 {
+			m.Literals = func(relpath, fname string, lit *dst.BasicLit, parent dst.Node) bool {
+				return MatchPath(path.Join(relpath, fname), rp.Literals...)
+			}
+		}
+		if len(rp.Extras) > 0 {
+			m.Extras = func(relpath, fname string) bool {
+				for _, pattern := range rp.Extras {
+					if ok, _ := path.Match(pattern, fname); ok {
+						return true
+					}
+				}
+				return false
+			}
+		}
+		mutators = append(mutators, m)
+	}
+	if mc.SkipTests != nil {
+		var m TestSkipper
+		for _, ts := range mc.SkipTests {
+			m = append(m, TestSkip{Path: ts.Path, Name: ts.Name, Comment: ts.Comment, Regexp: ts.Regexp, Expect: ts.Expect})
+		}
+		mutators = append(mutators, m)
+	}
+	if mc.Libify != nil {
+		platforms, err := parsePlatforms(mc.Libify.Platforms)
+		if err != nil {
+			return nil, fmt.Errorf("libify: %v", err)
+		}
+		mutators = append(mutators, Libify{Packages: mc.Libify.Packages, Platforms: platforms})
+	}
+	if mc.DeadCode != nil {
+		dc := mc.DeadCode
+		mutators = append(mutators, DeadCode{Packages: dc.Packages, Exported: dc.Exported, Used: dc.Used, DropTests: dc.DropTests})
+	}
+	if mc.Constraints != nil {
+		bc := mc.Constraints
+		platforms, err := parsePlatforms(bc.Platforms)
+		if err != nil {
+			return nil, fmt.Errorf("build_constraints: %v", err)
+		}
+		m := BuildConstraints{Platforms: platforms, Tags: bc.Tags}
+		switch bc.Action {
+		case "", "drop":
+			m.Action = ConstraintDrop
+		case "extras":
+			m.Action = ConstraintExtras
+		case "ignore":
+			m.Action = ConstraintIgnore
+		default:
+			return nil, fmt.Errorf("build_constraints: bad action %q (expected drop, extras or ignore)", bc.Action)
+		}
+		mutators = append(mutators, m)
+	}
+	if mc.Cleanup != nil {
+		m, err := mc.Cleanup.Build()
+		if err != nil {
+			return nil, err
+		}
+		mutators = append(mutators, m)
+	}
+	if len(mutators) != 1 {
+		return nil, errors.New("exactly one of filter, keep_deps, replace_paths, skip_tests, libify, dead_code, build_constraints or cleanup must be set")
+	}
+	if mc.Expect != nil {
+		return Expecting(mutators[0], mc.Expect), nil
+	}
+	return mutators[0], nil
+}
+
+func parsePlatforms(specs []string) ([]Platform, error) {
+	var platforms []Platform
+	for _, spec := range specs {
+		parts := strings.Split(spec, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("bad platform %q (expected GOOS/GOARCH)", spec)
+		}
+		platforms = append(platforms, Platform{GOOS: parts[0], GOARCH: parts[1]})
+	}
+	return platforms, nil
+}
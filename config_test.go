@@ -0,0 +1,132 @@
+package forky
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/src-d/go-billy.v4/util"
+)
+
+func TestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	load := func(contents string) (*Config, error) {
+		fpath := filepath.Join(dir, "forky.yaml")
+		if err := ioutil.WriteFile(fpath, []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return LoadConfig(fpath)
+	}
+
+	c, err := load(`
+dir: src
+source: a.com/a
+destination: b.com/b
+parse:
+  exclude: [a/testdata]
+mutators:
+  - filter:
+      delete: [c]
+  - replace_paths:
+      matchers: [a.com/a]
+      replacement: ${1}b.com/b${3}
+      extras: ["*.txt"]
+  - skip_tests:
+      - {path: a, name: TestA, comment: skipped}
+  - libify:
+      packages: [a]
+      platforms: [linux/amd64]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Dir != filepath.Join(dir, "src") {
+		t.Fatalf("dir should be relative to the config file, got %s", c.Dir)
+	}
+	mutators, err := c.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, m := range mutators {
+		names = append(names, mutatorName(m))
+	}
+	if strings.Join(names, " ") != "forky.FilterFiles forky.PathReplacer forky.TestSkipper forky.Libify" {
+		t.Fatalf("unexpected mutators %v", names)
+	}
+	if p := mutators[3].(Libify).Platforms; len(p) != 1 || p[0] != (Platform{"linux", "amd64"}) {
+		t.Fatalf("unexpected platforms %v", p)
+	}
+
+	s, err := c.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Observer = NewTextObserver(&bytes.Buffer{})
+	s.fs = newMemFS()
+	s.dir = "/src"
+	s.gopathsrc = "/"
+	files := map[string]string{
+		"a/a.go":          "package a\n\nvar A = \"a.com/a/x\"\n",
+		"a/a_test.go":     "package a\n\nfunc TestA(t *T) {}\n",
+		"a/a.txt":         "a.com/a\n",
+		"a/testdata/t.go": "package t\n",
+		"c/c.go":          "package c\n",
+	}
+	for fpath, contents := range files {
+		if err := util.WriteFile(s.fs, filepath.Join("/src", fpath), []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Run(mutators[:3]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"a/a.go":          "package a\n\nvar A = \"b.com/b/x\"\n",
+		"a/a.txt":         "b.com/b\n",
+		"a/testdata/t.go": "package t\n",
+	}
+	for fpath, contents := range expected {
+		found, err := readFile(s.fs, filepath.Join("/b.com/b", fpath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(found) != contents {
+			t.Fatalf("unexpected contents in %s:\n%s", fpath, string(found))
+		}
+	}
+	found, err := readFile(s.fs, "/b.com/b/a/a_test.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(found), `t.Skip("skipped")`) {
+		t.Fatalf("TestA should be skipped:\n%s", string(found))
+	}
+	if _, err := s.fs.Stat("/b.com/b/c/c.go"); err == nil {
+		t.Fatal("c/c.go should be deleted")
+	}
+
+	for contents, expected := range map[string]string{
+		"dir: a\nfoo: bar\n": "field foo not found",
+		"dir: a\nmutators:\n  - filter: {}\n    libify: {}\n":               "mutator 1: exactly one of",
+		"dir: a\nmutators:\n  - libify: {platforms: [linux]}\n":             `mutator 1: libify: bad platform "linux"`,
+		"dir: a\nmutators:\n  - replace_paths: {extras: [\"[\"]}\n":         `bad extras pattern "["`,
+		"dir: a\nmutators:\n  - skip_tests: [{path: a, name: b}]\n  - {}\n": "mutator 2: exactly one of",
+	} {
+		_, err := load(contents)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%q: expected error containing %q, got %v", contents, expected, err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package forky
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/dave/dst"
+)
+
+// BuildConstraints evaluates the file name suffixes (e.g. _windows.go) and build constraints of the
+// go files against the target platforms and tags, and applies Action to the files that aren't
+// built on any of the platforms.
+type BuildConstraints struct {
+	Platforms []Platform // defaults to the host platform
+	Tags      []string   // custom build tags that are set
+	Action    ConstraintAction
+}
+
+type ConstraintAction int
+
+const (
+	ConstraintDrop   ConstraintAction = iota // delete the file
+	ConstraintExtras                         // move the file to the extras: it's copied to the output, but not mutated
+	ConstraintIgnore                         // replace the build constraints of the file with "// +build ignore"
+)
+
+func (m BuildConstraints) Apply(s *Session) Applier {
+	return Applier{
+		Func: func() {
+			s.applyConstraints(m)
+		},
+	}
+}
+
+func (s *Session) applyConstraints(m BuildConstraints) {
+	platforms := m.Platforms
+	if len(platforms) == 0 {
+		platforms = []Platform{{}}
+	}
+	for _, relpath := range s.relpaths() {
+		info := s.paths[relpath]
+		var changed bool
+		for pkgname, pkg := range info.Packages {
+			for _, fname := range sortedFiles(pkg) {
+				file := pkg.Files[fname]
+				buf := &bytes.Buffer{}
+				if err := s.fprint(buf, relpath, file); err != nil {
+					// the file is kept unchanged
+					s.report(&Error{Pos: s.nodePosition(relpath, fname, nil), Mutator: mutatorName(m), Err: err})
+					continue
+				}
+				contents := buf.Bytes()
+				if s.matchConstraints(platforms, m.Tags, info.Dir, fname, contents) {
+					continue
+				}
+				switch m.Action {
+				case ConstraintDrop:
+					delete(pkg.Files, fname)
+				case ConstraintExtras:
+					delete(pkg.Files, fname)
+					info.Extras[fname] = true
+					info.Contents[fname] = contents
+				case ConstraintIgnore:
+					ignoreConstraints(file)
+				}
+				changed = true
+			}
+			if len(pkg.Files) == 0 {
+				delete(info.Packages, pkgname)
+			}
+		}
+		if changed {
+			info.Default = info.Packages[defaultName(info)]
+		}
+	}
+}
+
+// matchConstraints returns true if a file is built on any of the platforms.
+func (s *Session) matchConstraints(platforms []Platform, tags []string, dir, fname string, contents []byte) bool {
+	for _, p := range platforms {
+		ctxt := s.buildContext(p)
+		ctxt.BuildTags = tags
+		ctxt.OpenFile = func(string) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(contents)), nil
+		}
+		if ok, err := ctxt.MatchFile(dir, fname); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ignoreConstraints replaces the build constraints of a file with an ignore constraint.
+func ignoreConstraints(file *dst.File) {
+	var decs []string
+	var gobuild bool
+	for _, d := range file.Decs.Start {
+		if strings.HasPrefix(d, "//go:build") {
+			gobuild = true
+			continue
+		}
+		if strings.HasPrefix(d, "// +build") {
+			continue
+		}
+		decs = append(decs, d)
+	}
+	// drop the blank lines that separated the constraints from the package clause
+	for len(decs) > 0 && decs[0] == "\n" {
+		decs = decs[1:]
+	}
+	ignore := []string{"// +build ignore", "\n"}
+	if gobuild {
+		ignore = []string{"//go:build ignore", "// +build ignore", "\n"}
+	}
+	file.Decs.Start.Replace(append(ignore, decs...)...)
+}
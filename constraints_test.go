@@ -0,0 +1,107 @@
+package forky
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestBuildConstraints(t *testing.T) {
+	files := map[string]string{
+		"a/a.go":         "package a\n",
+		"a/a_linux.go":   "package a\n",
+		"a/a_windows.go": "package a\n",
+		"a/tag.go":       "// +build custom\n\npackage a\n",
+		"a/both.go":      "//go:build linux && !custom\n// +build linux,!custom\n\n// Package comment.\npackage a\n",
+		"a/gen.go":       "// +build ignore\n\npackage main\n",
+	}
+	run := func(m BuildConstraints) *Session {
+		s := newTestSession(t, files)
+		if err := s.Run([]Mutator{m}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Save(); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	gofiles := func(s *Session) string {
+		var fnames []string
+		for _, pkg := range s.paths["a"].Packages {
+			fnames = append(fnames, sortedFiles(pkg)...)
+		}
+		sort.Strings(fnames)
+		return strings.Join(fnames, " ")
+	}
+	linux := []Platform{{"linux", "amd64"}}
+
+	s := run(BuildConstraints{Platforms: linux})
+	if found, expected := gofiles(s), "a.go a_linux.go both.go"; found != expected {
+		t.Fatalf("drop: expected %s, found %s", expected, found)
+	}
+	if s.paths["a"].Default == nil || s.paths["a"].Default.Name != "a" {
+		t.Fatal("drop: expected default package a")
+	}
+	if _, err := readFile(s.fs, "/out/a/gen.go"); err == nil {
+		t.Fatal("drop: expected gen.go to be deleted")
+	}
+
+	s = run(BuildConstraints{Platforms: append(linux, Platform{"windows", "amd64"}), Tags: []string{"custom"}, Action: ConstraintExtras})
+	if found, expected := gofiles(s), "a.go a_linux.go a_windows.go tag.go"; found != expected {
+		t.Fatalf("extras: expected %s, found %s", expected, found)
+	}
+	for _, fname := range []string{"both.go", "gen.go"} {
+		if !s.paths["a"].Extras[fname] {
+			t.Fatalf("extras: expected %s in extras", fname)
+		}
+		b, err := readFile(s.fs, "/out/a/"+fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), "// +build ") {
+			t.Fatalf("extras: unexpected contents of %s: %q", fname, b)
+		}
+	}
+
+	s = run(BuildConstraints{Platforms: linux, Action: ConstraintIgnore})
+	if found, expected := gofiles(s), "a.go a_linux.go a_windows.go both.go gen.go tag.go"; found != expected {
+		t.Fatalf("ignore: expected %s, found %s", expected, found)
+	}
+	// newer versions of gofmt add a //go:build line to files with +build lines, so only the +build
+	// lines are checked
+	expected := map[string]string{
+		"a.go":         "",
+		"a_windows.go": "// +build ignore\n",
+		"tag.go":       "// +build ignore\n",
+		"both.go":      "// +build linux,!custom\n",
+		"gen.go":       "// +build ignore\n",
+	}
+	for fname, constraint := range expected {
+		b, err := readFile(s.fs, "/out/a/"+fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found := strings.Join(buildLines(string(b)), ""); found != constraint {
+			t.Fatalf("ignore: expected %s to have constraint %q, found %q", fname, constraint, found)
+		}
+	}
+
+	s = run(BuildConstraints{Platforms: linux, Tags: []string{"custom"}, Action: ConstraintIgnore})
+	b, err := readFile(s.fs, "/out/a/both.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "linux") || !strings.HasSuffix(string(b), "// +build ignore\n\n// Package comment.\npackage a\n") {
+		t.Fatalf("ignore: unexpected contents of both.go: %q", b)
+	}
+}
+
+func buildLines(src string) []string {
+	var lines []string
+	for _, line := range strings.SplitAfter(src, "\n") {
+		if strings.HasPrefix(line, "// +build") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
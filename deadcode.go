@@ -0,0 +1,417 @@
+package forky
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dave/dst"
+)
+
+// DeadCode deletes the package level funcs, methods, types, vars and consts that are unreachable
+// from the roots, and then the imports that are no longer used. The roots are the main and init
+// funcs, the exported identifiers of the Exported packages, the identifiers listed in Used, and
+// everything outside Packages. A type is reachable if anything refers to it, and all methods of
+// a reachable type are kept (they may be needed to satisfy interfaces).
+//
+// The session is type checked for the host platform. Files that aren't type checked (test files
+// and files excluded by build constraints) are kept as they are, and everything with the name of
+// an identifier used in them is treated as reachable. Funcs without a body (implemented in
+// assembly), declarations with //go: or //export directives, the targets of //go:linkname
+// directives in other packages and vars initialized by calling a func are always kept.
+type DeadCode struct {
+	Packages  []string // MatchPath specs of the packages to delete unreachable declarations from
+	Exported  []string // MatchPath specs of the packages whose exported identifiers are roots
+	Used      []string // other roots, written relpath.Name (e.g. src/cmd/compile/internal/gc.Main)
+	DropTests bool     // delete the test files in Packages - otherwise they're kept, with everything they use
+}
+
+func (m DeadCode) Apply(s *Session) Applier {
+	return Applier{
+		Func: func() {
+			if !s.typed {
+				if err := s.load(); err != nil {
+					s.report(err)
+					return
+				}
+				s.typed = true
+			}
+			s.deadCode(m)
+		},
+	}
+}
+
+// deadUnit is a declaration that is kept or deleted as a whole: a func, a spec in a type or var
+// decl, or a const decl (consts are deleted together when they use iota or implicit values).
+type deadUnit struct {
+	file    *dst.File
+	decl    dst.Decl
+	spec    dst.Spec // nil if the whole decl is the unit
+	node    ast.Node // scanned for uses
+	info    *TypesInfo
+	objects []types.Object
+	used    bool
+}
+
+func (s *Session) deadCode(m DeadCode) {
+	used := map[string]map[string]bool{}
+	for _, u := range m.Used {
+		if i := strings.LastIndex(u, "."); i > -1 {
+			relpath, name := u[:i], u[i+1:]
+			if used[relpath] == nil {
+				used[relpath] = map[string]bool{}
+			}
+			used[relpath][name] = true
+		}
+	}
+	s.linknames(used)
+
+	var units []*deadUnit
+	var roots []*deadUnit
+	byObject := map[types.Object]*deadUnit{}
+	methods := map[types.Object][]*deadUnit{} // type name -> method units
+	names := map[string]bool{}                // identifiers used in files that aren't type checked
+
+	for _, relpath := range s.relpaths() {
+		info := s.paths[relpath]
+		scope := MatchPath(relpath, m.Packages...)
+		exported := MatchPath(relpath, m.Exported...)
+		s.asmNames(relpath, names)
+		for _, pkg := range info.Packages {
+			for _, fname := range sortedFiles(pkg) {
+				file := pkg.Files[fname]
+				if scope && m.DropTests && strings.HasSuffix(fname, "_test.go") {
+					delete(pkg.Files, fname)
+					continue
+				}
+				if pkg.Info == nil || pkg.NodesAst[file] == nil {
+					dst.Inspect(file, func(n dst.Node) bool {
+						if id, ok := n.(*dst.Ident); ok {
+							names[id.Name] = true
+						}
+						return true
+					})
+					continue
+				}
+				add := func(u *deadUnit, root bool) {
+					units = append(units, u)
+					for _, obj := range u.objects {
+						if obj == nil {
+							root = true
+							continue
+						}
+						byObject[obj] = u
+						if !scope || obj.Name() == "_" || used[relpath][obj.Name()] || exported && obj.Exported() {
+							root = true
+						}
+					}
+					if root {
+						roots = append(roots, u)
+					}
+				}
+				for _, decl := range file.Decls {
+					switch decl := decl.(type) {
+					case *dst.FuncDecl:
+						obj := pkg.Info.Defs[pkg.NodesAst.Ident(decl.Name)]
+						root := decl.Body == nil || hasDirective(decl.Decs.Start)
+						if decl.Recv == nil {
+							root = root || decl.Name.Name == "init" || decl.Name.Name == "main" && pkg.Name == "main"
+						} else if fn, ok := obj.(*types.Func); ok {
+							if named := receiverNamed(fn); named != nil {
+								u := &deadUnit{file: file, decl: decl, node: pkg.NodesAst[decl], info: pkg.Info, objects: []types.Object{obj}}
+								methods[named.Obj()] = append(methods[named.Obj()], u)
+								add(u, root)
+								continue
+							}
+						}
+						add(&deadUnit{file: file, decl: decl, node: pkg.NodesAst[decl], info: pkg.Info, objects: []types.Object{obj}}, root)
+					case *dst.GenDecl:
+						if decl.Tok == token.IMPORT {
+							continue
+						}
+						root := hasDirective(decl.Decs.Start)
+						if decl.Tok == token.CONST && usesIota(decl) {
+							u := &deadUnit{file: file, decl: decl, node: pkg.NodesAst[decl], info: pkg.Info}
+							for _, spec := range decl.Specs {
+								for _, id := range spec.(*dst.ValueSpec).Names {
+									u.objects = append(u.objects, pkg.Info.Defs[pkg.NodesAst.Ident(id)])
+								}
+							}
+							add(u, root)
+							continue
+						}
+						for _, spec := range decl.Specs {
+							u := &deadUnit{file: file, decl: decl, spec: spec, node: pkg.NodesAst[spec], info: pkg.Info}
+							switch spec := spec.(type) {
+							case *dst.TypeSpec:
+								u.objects = append(u.objects, pkg.Info.Defs[pkg.NodesAst.Ident(spec.Name)])
+							case *dst.ValueSpec:
+								for _, id := range spec.Names {
+									u.objects = append(u.objects, pkg.Info.Defs[pkg.NodesAst.Ident(id)])
+								}
+							}
+							add(u, root || hasDirective(spec.Decorations().Start) || callsFunc(pkg.Info, u.node))
+						}
+					}
+				}
+			}
+		}
+	}
+
+	for _, u := range units {
+		for _, obj := range u.objects {
+			if obj != nil && names[obj.Name()] {
+				roots = append(roots, u)
+				break
+			}
+		}
+	}
+
+	// mark everything reachable from the roots
+	queue := roots
+	for len(queue) > 0 {
+		u := queue[0]
+		queue = queue[1:]
+		if u.used {
+			continue
+		}
+		u.used = true
+		for _, obj := range u.objects {
+			queue = append(queue, methods[obj]...)
+		}
+		ast.Inspect(u.node, func(n ast.Node) bool {
+			if id, ok := n.(*ast.Ident); ok {
+				if dep := byObject[u.info.Uses[id]]; dep != nil && !dep.used {
+					queue = append(queue, dep)
+				}
+			}
+			return true
+		})
+	}
+
+	// delete the rest
+	changed := map[*dst.File]bool{}
+	for _, u := range units {
+		if u.used {
+			continue
+		}
+		changed[u.file] = true
+		if u.spec == nil {
+			u.file.Decls = removeDecl(u.file.Decls, u.decl)
+			continue
+		}
+		gd := u.decl.(*dst.GenDecl)
+		for i, spec := range gd.Specs {
+			if spec == u.spec {
+				gd.Specs = append(gd.Specs[:i:i], gd.Specs[i+1:]...)
+				break
+			}
+		}
+		if len(gd.Specs) == 0 {
+			u.file.Decls = removeDecl(u.file.Decls, gd)
+		}
+	}
+	for file := range changed {
+		removeUnusedImports(file)
+	}
+}
+
+// linknames adds the targets of the //go:linkname directives in the session to used (relpath ->
+// name), so the declarations they refer to are kept. For methods only the method name is used.
+func (s *Session) linknames(used map[string]map[string]bool) {
+	add := func(decs dst.Decorations) {
+		for _, d := range decs {
+			pkgpath, name, ok := linknameTarget(d)
+			if !ok {
+				continue
+			}
+			relpath, ok := s.Rel(pkgpath)
+			if !ok {
+				continue
+			}
+			if used[relpath] == nil {
+				used[relpath] = map[string]bool{}
+			}
+			used[relpath][name[strings.LastIndex(name, ".")+1:]] = true
+		}
+	}
+	for _, relpath := range s.relpaths() {
+		for _, pkg := range s.paths[relpath].Packages {
+			for _, fname := range sortedFiles(pkg) {
+				file := pkg.Files[fname]
+				add(file.Decs.Package)
+				add(file.Decs.Name)
+				dst.Inspect(file, func(n dst.Node) bool {
+					if n == nil {
+						return false
+					}
+					add(n.Decorations().Start)
+					add(n.Decorations().End)
+					return true
+				})
+			}
+		}
+	}
+}
+
+func sortedFiles(pkg *PackageInfo) []string {
+	var fnames []string
+	for fname, file := range pkg.Files {
+		if file != nil {
+			fnames = append(fnames, fname)
+		}
+	}
+	sort.Strings(fnames)
+	return fnames
+}
+
+// asmNames adds the names of the symbols in the assembly files in relpath to names.
+func (s *Session) asmNames(relpath string, names map[string]bool) {
+	info := s.paths[relpath]
+	for fname := range info.Extras {
+		if !strings.HasSuffix(fname, ".s") {
+			continue
+		}
+		b, ok := info.Contents[fname]
+		if !ok {
+			var err error
+			if b, err = readFile(s.srcFS(), filepath.Join(s.dir, relpath, fname)); err != nil {
+				continue
+			}
+		}
+		for _, match := range asmName.FindAllSubmatch(b, -1) {
+			names[string(match[1])] = true
+		}
+	}
+}
+
+func receiverNamed(fn *types.Func) *types.Named {
+	recv := fn.Type().(*types.Signature).Recv()
+	if recv == nil {
+		return nil
+	}
+	t := recv.Type()
+	if p, ok := t.(*types.Pointer); ok {
+		t = p.Elem()
+	}
+	named, _ := t.(*types.Named)
+	return named
+}
+
+func hasDirective(decs dst.Decorations) bool {
+	for _, d := range decs {
+		if strings.HasPrefix(d, "//go:") || strings.HasPrefix(d, "//export ") {
+			return true
+		}
+	}
+	return false
+}
+
+// usesIota returns true if the values of a const decl depend on the position of the specs.
+func usesIota(decl *dst.GenDecl) bool {
+	var found bool
+	for _, spec := range decl.Specs {
+		vs := spec.(*dst.ValueSpec)
+		if len(vs.Values) == 0 {
+			return true
+		}
+		dst.Inspect(vs, func(n dst.Node) bool {
+			if id, ok := n.(*dst.Ident); ok && id.Name == "iota" {
+				found = true
+			}
+			return !found
+		})
+	}
+	return found
+}
+
+// callsFunc returns true if a node contains a call to a func (rather than a conversion or a
+// builtin), so deleting it could change the behaviour of the program.
+func callsFunc(info *TypesInfo, node ast.Node) bool {
+	var found bool
+	ast.Inspect(node, func(n ast.Node) bool {
+		if found {
+			return false
+		}
+		if _, ok := n.(*ast.FuncLit); ok {
+			return false
+		}
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		if tv, ok := info.Types[call.Fun]; ok && (tv.IsType() || tv.IsBuiltin()) {
+			return true
+		}
+		found = true
+		return false
+	})
+	return found
+}
+
+func removeDecl(decls []dst.Decl, decl dst.Decl) []dst.Decl {
+	for i, d := range decls {
+		if d == decl {
+			return append(decls[:i:i], decls[i+1:]...)
+		}
+	}
+	return decls
+}
+
+// removeUnusedImports deletes the imports of a type checked file that aren't referred to by any
+// qualified identifier. Blank, dot and cgo imports are kept.
+func removeUnusedImports(file *dst.File) {
+	used := map[string]bool{}
+	dst.Inspect(file, func(n dst.Node) bool {
+		if id, ok := n.(*dst.Ident); ok && id.Path != "" {
+			used[id.Path] = true
+		}
+		return true
+	})
+	removeImports(file, func(is *dst.ImportSpec) bool {
+		p, err := strconv.Unquote(is.Path.Value)
+		return err != nil || used[p] || p == "C" || is.Name != nil && (is.Name.Name == "_" || is.Name.Name == ".")
+	})
+}
+
+// removeImports deletes the imports of a file that keep returns false for, and the import decls
+// that are left empty.
+func removeImports(file *dst.File, keep func(*dst.ImportSpec) bool) {
+	var decls []dst.Decl
+	for _, decl := range file.Decls {
+		gd, ok := decl.(*dst.GenDecl)
+		if !ok || gd.Tok != token.IMPORT {
+			decls = append(decls, decl)
+			continue
+		}
+		var specs []dst.Spec
+		for _, spec := range gd.Specs {
+			if keep(spec.(*dst.ImportSpec)) {
+				specs = append(specs, spec)
+			}
+		}
+		if len(specs) == 0 {
+			continue
+		}
+		gd.Specs = specs
+		decls = append(decls, gd)
+	}
+	file.Decls = decls
+	var imports []*dst.ImportSpec
+	for _, imp := range file.Imports {
+		for _, decl := range decls {
+			if gd, ok := decl.(*dst.GenDecl); ok && gd.Tok == token.IMPORT {
+				for _, spec := range gd.Specs {
+					if spec == imp {
+						imports = append(imports, imp)
+					}
+				}
+			}
+		}
+	}
+	file.Imports = imports
+}
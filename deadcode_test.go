@@ -0,0 +1,114 @@
+package forky
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDeadCode(t *testing.T) {
+	files := map[string]string{
+		"a/a.go": `package a
+
+import (
+	"fmt"
+	"strings"
+)
+
+func Used() { helper(); fmt.Println(T{}) }
+
+func helper() {}
+
+func unused() { strings.ToUpper("") }
+
+func usedByTest() {}
+
+type T struct{}
+
+func (T) String() string { return "" }
+
+type U struct{}
+
+func (U) M() {}
+
+var v = 1
+
+var w = register()
+
+func register() int { return 0 }
+
+const (
+	A = iota
+	B
+)
+
+func init() {}
+`,
+		"a/a_test.go":  "package a\n\nfunc TestA(t *T) { usedByTest() }\n",
+		"a/link.go":    "package a\n\nimport _ \"unsafe\"\n\n//go:linkname impl c.impl\nfunc impl()\n",
+		"b/b.go":       "package b\n\nfunc unused() {}\n",
+		"c/c.go":       "package c\n\nfunc impl() {}\n\nfunc unused() {}\n",
+		"main/main.go": "package main\n\nimport \"a\"\n\nfunc main() { a.Used() }\n\nfunc unused() {}\n",
+	}
+	type spec struct{ kept, deleted []string }
+	run := func(m DeadCode, specs map[string]spec) {
+		t.Helper()
+		s := newTestSession(t, files)
+		if err := s.Run([]Mutator{m}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Save(); err != nil {
+			t.Fatal(err)
+		}
+		for fpath, spec := range specs {
+			found, err := readFile(s.fs, "/out/"+fpath)
+			if spec.kept == nil && spec.deleted == nil {
+				if err == nil {
+					t.Fatalf("%s should be deleted", fpath)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range spec.kept {
+				if !strings.Contains(string(found), c) {
+					t.Fatalf("%s should contain %q:\n%s", fpath, c, string(found))
+				}
+			}
+			for _, c := range spec.deleted {
+				if strings.Contains(string(found), c) {
+					t.Fatalf("%s should not contain %q:\n%s", fpath, c, string(found))
+				}
+			}
+		}
+	}
+
+	run(DeadCode{Packages: []string{"a", "c", "main"}}, map[string]spec{
+		"a/a.go": {
+			kept:    []string{"func Used()", "func helper()", "func usedByTest()", "type T struct", "func (T) String()", "var w", "func register()", "func init()", `"fmt"`},
+			deleted: []string{"func unused()", `"strings"`, "type U", "func (U) M()", "var v", "iota"},
+		},
+		"a/a_test.go": {
+			kept: []string{"func TestA("},
+		},
+		"b/b.go": {
+			kept: []string{"func unused()"},
+		},
+		"c/c.go": {
+			kept:    []string{"func impl()"},
+			deleted: []string{"func unused()"},
+		},
+		"main/main.go": {
+			kept:    []string{"func main()"},
+			deleted: []string{"func unused()"},
+		},
+	})
+
+	run(DeadCode{Packages: []string{"a"}, DropTests: true}, map[string]spec{
+		"a/a.go": {
+			kept:    []string{"func Used()"},
+			deleted: []string{"func usedByTest()"},
+		},
+		"a/a_test.go": {},
+	})
+}
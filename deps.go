@@ -0,0 +1,185 @@
+package forky
+
+import (
+	"fmt"
+	"go/build"
+	"io"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// KeepDeps deletes all files except those in the root packages and the packages they import,
+// directly or indirectly, from the source tree. Imports in test files are followed, and build
+// constraints are evaluated for each of the platforms. The testdata dirs of the packages that are
+// kept are also kept.
+type KeepDeps struct {
+	Roots     []string   // relpaths of the root packages
+	SrcDirs   []string   // relpaths of dirs that import paths are resolved in, like GOROOT/src (e.g. "src" in the go repo)
+	Scope     []string   // MatchPath specs of the dirs that imports are followed into - all dirs if empty
+	Keep      []string   // MatchPath specs of other dirs to keep
+	Platforms []Platform // platforms to evaluate build constraints for - defaults to the host platform
+}
+
+func (m KeepDeps) Apply(s *Session) Applier {
+	var keep map[string]bool
+	var failed bool
+	return Applier{
+		FileFilter: func(relpath, fname string) bool {
+			if keep == nil && !failed {
+				var err error
+				if keep, err = s.deps(m); err != nil {
+					// keep everything rather than deleting packages that may be needed
+					s.report(err)
+					failed = true
+				}
+			}
+			if failed || keep[relpath] || MatchPath(relpath, m.Keep...) {
+				return true
+			}
+			if s.modules && relpath == "." && (fname == "go.mod" || fname == "go.sum") {
+				return true
+			}
+			// testdata dirs belong to the package that contains them
+			parts := strings.Split(relpath, "/")
+			for i, part := range parts {
+				if part == "testdata" {
+					owner := path.Join(parts[:i]...)
+					if owner == "" {
+						owner = "."
+					}
+					return keep[owner]
+				}
+			}
+			return false
+		},
+	}
+}
+
+// deps returns the relpaths of the root packages of m and their dependencies in the source.
+func (s *Session) deps(m KeepDeps) (map[string]bool, error) {
+	platforms := m.Platforms
+	if len(platforms) == 0 {
+		platforms = []Platform{{}}
+	}
+	var contexts []*build.Context
+	for _, p := range platforms {
+		contexts = append(contexts, s.buildContext(p))
+	}
+
+	keep := map[string]bool{}
+	var queue []string
+	for _, root := range m.Roots {
+		root = dirToPath(root)
+		if root == "" {
+			root = "."
+		}
+		if !s.isSrcDir(root) {
+			return nil, fmt.Errorf("root package %s not found", root)
+		}
+		queue = append(queue, root)
+	}
+	for len(queue) > 0 {
+		relpath := queue[0]
+		queue = queue[1:]
+		if keep[relpath] {
+			continue
+		}
+		keep[relpath] = true
+
+		imports := map[string]bool{}
+		for _, ctxt := range contexts {
+			pkg, err := ctxt.ImportDir(filepath.Join(s.dir, relpath), 0)
+			if _, ok := err.(*build.NoGoError); ok {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("%s: %v", relpath, err)
+			}
+			for _, list := range [][]string{pkg.Imports, pkg.TestImports, pkg.XTestImports} {
+				for _, imp := range list {
+					imports[imp] = true
+				}
+			}
+		}
+		var sorted []string
+		for imp := range imports {
+			sorted = append(sorted, imp)
+		}
+		sort.Strings(sorted)
+		for _, imp := range sorted {
+			dep, ok := s.resolveImport(m, relpath, imp)
+			if !ok || keep[dep] {
+				continue
+			}
+			if len(m.Scope) > 0 && !MatchPath(dep, m.Scope...) {
+				continue
+			}
+			queue = append(queue, dep)
+		}
+	}
+	return keep, nil
+}
+
+// resolveImport returns the relpath of an imported package, if it's in the source. Vendor dirs
+// are searched first, then the source path and then the SrcDirs of m.
+func (s *Session) resolveImport(m KeepDeps, from, imp string) (string, bool) {
+	if imp == "C" || build.IsLocalImport(imp) {
+		return "", false
+	}
+	for dir := from; ; dir = path.Dir(dir) {
+		if vendored := path.Join(dir, "vendor", imp); s.isSrcDir(vendored) {
+			return vendored, true
+		}
+		if dir == "." {
+			break
+		}
+	}
+	if s.source != "" && (imp == s.source || strings.HasPrefix(imp, s.source+"/")) {
+		relpath := strings.TrimPrefix(strings.TrimPrefix(imp, s.source), "/")
+		if relpath == "" {
+			relpath = "."
+		}
+		if s.isSrcDir(relpath) {
+			return relpath, true
+		}
+	}
+	for _, dir := range m.SrcDirs {
+		if relpath := path.Join(dir, imp); s.isSrcDir(relpath) {
+			return relpath, true
+		}
+	}
+	return "", false
+}
+
+func (s *Session) isSrcDir(relpath string) bool {
+	fi, err := s.srcFS().Stat(filepath.Join(s.dir, relpath))
+	return err == nil && fi.IsDir()
+}
+
+// buildContext returns a build context for a platform that reads files from the source.
+func (s *Session) buildContext(p Platform) *build.Context {
+	ctxt := build.Default
+	if p.GOOS != "" {
+		ctxt.GOOS = p.GOOS
+	}
+	if p.GOARCH != "" {
+		ctxt.GOARCH = p.GOARCH
+	}
+	if ctxt.GOOS != runtime.GOOS || ctxt.GOARCH != runtime.GOARCH {
+		// cgo is disabled when cross compiling
+		ctxt.CgoEnabled = false
+	}
+	fs := s.srcFS()
+	ctxt.JoinPath = filepath.Join
+	ctxt.IsDir = func(p string) bool {
+		fi, err := fs.Stat(p)
+		return err == nil && fi.IsDir()
+	}
+	ctxt.ReadDir = fs.ReadDir
+	ctxt.OpenFile = func(p string) (io.ReadCloser, error) {
+		return fs.Open(p)
+	}
+	return &ctxt
+}
@@ -0,0 +1,54 @@
+package forky
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeepDeps(t *testing.T) {
+	files := map[string]string{
+		"a/a.go":                      "package a\n\nimport (\n\t\"fmt\"\n\t\"x/b\"\n\t\"a.com/e\"\n)\n",
+		"a/a_test.go":                 "package a\n\nimport \"x/t\"\n",
+		"a/a_windows.go":              "package a\n\nimport \"x/w\"\n",
+		"a/a_plan9.go":                "package a\n\nimport \"x/p\"\n",
+		"e/e.go":                      "package e\n",
+		"lib/fmt/fmt.go":              "package fmt\n",
+		"lib/x/b/b.go":                "package b\n\nimport (\n\t\"d\"\n\t\"x/c\"\n)\n",
+		"lib/x/b/testdata/t.txt":      "data\n",
+		"lib/x/c/c.go":                "package c\n",
+		"lib/x/vendor/d/d.go":         "package d\n",
+		"lib/x/t/t.go":                "package t\n",
+		"lib/x/w/w.go":                "package w\n",
+		"lib/x/p/p.go":                "package p\n",
+		"lib/x/unused/u.go":           "package unused\n",
+		"lib/x/unused/testdata/t.txt": "data\n",
+		"misc/m.txt":                  "misc\n",
+	}
+	s := newTestSession(t, files)
+	s.source = "a.com"
+	err := s.Run([]Mutator{KeepDeps{
+		Roots:     []string{"a"},
+		SrcDirs:   []string{"lib"},
+		Scope:     []string{"a", "e", "lib/x/**"},
+		Keep:      []string{"misc"},
+		Platforms: []Platform{{"linux", "amd64"}, {"windows", "amd64"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "a e lib/x/b lib/x/b/testdata lib/x/c lib/x/t lib/x/vendor/d lib/x/w misc"
+	var kept []string
+	for _, relpath := range s.relpaths() {
+		if len(s.paths[relpath].Packages) > 0 || len(s.paths[relpath].Extras) > 0 {
+			kept = append(kept, relpath)
+		}
+	}
+	if found := strings.Join(kept, " "); found != expected {
+		t.Fatalf("expected %s, found %s", expected, found)
+	}
+
+	err = s.Run([]Mutator{KeepDeps{Roots: []string{"z"}}})
+	if err == nil || !strings.Contains(err.Error(), "root package z not found") {
+		t.Fatalf("expected error, got %v", err)
+	}
+}
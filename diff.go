@@ -0,0 +1,112 @@
+package forky
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dave/services/fsutil"
+	"github.com/pmezard/go-difflib/difflib"
+	"gopkg.in/src-d/go-billy.v4"
+)
+
+// Diff writes a unified diff between the source files and the output to w, without writing
+// anything to the destination. Files deleted from the output are diffed against /dev/null, as are
+// files that only exist in the output (e.g. package-state.go).
+func (s *Session) Diff(w io.Writer) error {
+	outfs, err := s.render("Diffing", s.destinationDir())
+	if err != nil {
+		return err
+	}
+
+	source, err := s.getFiles()
+	if err != nil {
+		return err
+	}
+
+	// all file paths relative to the root -> true
+	sourceFiles := map[string]bool{}
+	for relpath, files := range source {
+		for fname := range files {
+			sourceFiles[path.Join(relpath, fname)] = true
+		}
+	}
+	outputFiles := map[string]bool{}
+	if err := fsutil.Walk(outfs, "/", func(fs billy.Filesystem, fpath string, finfo os.FileInfo, err error) error {
+		if finfo == nil || finfo.IsDir() {
+			return nil
+		}
+		outputFiles[strings.TrimPrefix(filepath.ToSlash(fpath), "/")] = true
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	var all []string
+	for fpath := range sourceFiles {
+		all = append(all, fpath)
+	}
+	for fpath := range outputFiles {
+		if !sourceFiles[fpath] {
+			all = append(all, fpath)
+		}
+	}
+	sort.Strings(all)
+
+	for _, fpath := range all {
+		var a, b []byte
+		from, to := "a/"+fpath, "b/"+fpath
+		if sourceFiles[fpath] {
+			if a, err = readFile(s.srcFS(), filepath.Join(s.dir, fpath)); err != nil {
+				return err
+			}
+		} else {
+			from = "/dev/null"
+		}
+		if outputFiles[fpath] {
+			if b, err = readFile(outfs, filepath.Join("/", fpath)); err != nil {
+				return err
+			}
+		} else {
+			to = "/dev/null"
+		}
+		if sourceFiles[fpath] && outputFiles[fpath] && bytes.Equal(a, b) {
+			continue
+		}
+		if isBinary(a) || isBinary(b) {
+			fmt.Fprintf(w, "Binary files %s and %s differ\n", from, to)
+			continue
+		}
+		if err := difflib.WriteUnifiedDiff(w, difflib.UnifiedDiff{
+			A:        splitLines(a),
+			B:        splitLines(b),
+			FromFile: from,
+			ToFile:   to,
+			Context:  3,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func splitLines(b []byte) []string {
+	if len(b) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	if lines[len(lines)-1] == "" {
+		return lines[:len(lines)-1]
+	}
+	lines[len(lines)-1] += "\n\\ No newline at end of file\n"
+	return lines
+}
+
+func isBinary(b []byte) bool {
+	return bytes.IndexByte(b, 0) >= 0
+}
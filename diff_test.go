@@ -0,0 +1,58 @@
+package forky
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	files := map[string]string{
+		"a/a.go":  "package a\n\nvar a = \"foo\"\n",
+		"a/b.go":  "package a\n\nvar b = \"b\"\n",
+		"a/c.txt": "c\n",
+	}
+	s := newTestSession(t, files)
+	err := s.Run([]Mutator{
+		FilterFiles(func(relpath, fname string) bool {
+			return fname != "c.txt"
+		}),
+		ModifyStrings(func(s string) string {
+			if s == "foo" {
+				return "bar"
+			}
+			return s
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := s.Diff(buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `--- a/a/a.go
++++ b/a/a.go
+@@ -1,3 +1,3 @@
+ package a
+ 
+-var a = "foo"
++var a = "bar"
+--- a/a/c.txt
++++ /dev/null
+@@ -1 +0,0 @@
+-c
+`
+	if strings.TrimSpace(buf.String()) != strings.TrimSpace(expected) {
+		t.Fatalf("unexpected diff:\n%s", buf.String())
+	}
+
+	// Diff must not write to the source
+	b, err := readFile(s.fs, "/a/a.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != files["a/a.go"] {
+		t.Fatalf("source modified: %q", string(b))
+	}
+}
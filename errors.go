@@ -0,0 +1,216 @@
+package forky
+
+import (
+	"fmt"
+	"go/token"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dave/dst"
+	"golang.org/x/tools/go/packages"
+)
+
+// Error is an error in a source file, reported by a mutator.
+type Error struct {
+	Pos     token.Position // position in the source dir - may only have the filename
+	Mutator string         // name of the mutator that reported the error, if any
+	Err     error
+}
+
+func (e *Error) Error() string {
+	var parts []string
+	if e.Pos.Filename != "" || e.Pos.IsValid() {
+		parts = append(parts, e.Pos.String())
+	}
+	if e.Mutator != "" {
+		parts = append(parts, e.Mutator)
+	}
+	parts = append(parts, e.Err.Error())
+	return strings.Join(parts, ": ")
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrorList is a list of errors. Session.Run returns an ErrorList when any mutator reports an
+// error, so every problem is reported in one pass.
+type ErrorList []*Error
+
+// Add appends an error to the list. An ErrorList is flattened into the list.
+func (l *ErrorList) Add(err error) {
+	switch err := err.(type) {
+	case nil:
+	case ErrorList:
+		*l = append(*l, err...)
+	case *Error:
+		*l = append(*l, err)
+	default:
+		*l = append(*l, &Error{Err: err})
+	}
+}
+
+func (l ErrorList) Len() int      { return len(l) }
+func (l ErrorList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
+func (l ErrorList) Less(i, j int) bool {
+	a, b := l[i].Pos, l[j].Pos
+	if a.Filename != b.Filename {
+		return a.Filename < b.Filename
+	}
+	if a.Line != b.Line {
+		return a.Line < b.Line
+	}
+	if a.Column != b.Column {
+		return a.Column < b.Column
+	}
+	return l[i].Err.Error() < l[j].Err.Error()
+}
+
+// Sort sorts the list by position. The sort is stable so errors without positions keep the order
+// they were reported in.
+func (l ErrorList) Sort() {
+	sort.Stable(l)
+}
+
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	lines := make([]string, len(l))
+	for i, e := range l {
+		lines[i] = e.Error()
+	}
+	return fmt.Sprintf("%d errors:\n%s", len(l), strings.Join(lines, "\n"))
+}
+
+// Err returns nil if the list is empty, or the list otherwise.
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+// Errorf reports an error at a node in a file. It may be called concurrently by appliers. The
+// error doesn't stop the session: Run carries on with the remaining files and mutators, and returns
+// all errors at the end.
+func (s *Session) Errorf(relpath, fname string, node dst.Node, format string, args ...interface{}) {
+	s.report(&Error{Pos: s.nodePosition(relpath, fname, node), Err: fmt.Errorf(format, args...)})
+}
+
+// report adds an error to the session, tagged with the mutator currently being applied.
+func (s *Session) report(err error) {
+	var l ErrorList
+	l.Add(err)
+	s.errsm.Lock()
+	defer s.errsm.Unlock()
+	for _, e := range l {
+		if e.Mutator == "" {
+			e.Mutator = s.mutator
+		}
+		s.errs = append(s.errs, e)
+	}
+}
+
+// nodePosition returns the position of a node in a file. Nodes that were not parsed from the source
+// (e.g. added by a mutator) only get the file name.
+func (s *Session) nodePosition(relpath, fname string, node dst.Node) token.Position {
+	if info := s.paths[relpath]; info != nil && node != nil {
+		for _, pkg := range info.Packages {
+			if n := pkg.NodesAst[node]; n != nil {
+				return s.position(relpath, fname, n.Pos())
+			}
+		}
+	}
+	return token.Position{Filename: filepath.Join(s.dir, relpath, fname)}
+}
+
+// position returns the position of pos in the source dir. The line and column are taken from the
+// file set, but the file name is set from relpath and fname because type checked files are loaded
+// from a temporary dir.
+func (s *Session) position(relpath, fname string, pos token.Pos) token.Position {
+	p := s.fset.Position(pos)
+	p.Filename = filepath.Join(s.dir, relpath, fname)
+	p.Offset = 0
+	return p
+}
+
+// packageErrors converts the errors from a packages.Load into an ErrorList. File names in the
+// temporary dir are converted to file names in the source dir.
+func (s *Session) packageErrors(root string, p Platform, pkgs []*packages.Package) ErrorList {
+	var l ErrorList
+	seen := map[packages.Error]bool{}
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		for _, e := range pkg.Errors {
+			// files in test variants of a package report the same errors again
+			if seen[e] {
+				continue
+			}
+			seen[e] = true
+			l.Add(&Error{Pos: s.packagePosition(root, e.Pos), Err: fmt.Errorf("%s: %s", p, e.Msg)})
+		}
+	})
+	l.Sort()
+	return l
+}
+
+// packagePosition parses a position from packages.Error (file:line:col, file:line, file or "-").
+func (s *Session) packagePosition(root, pos string) token.Position {
+	if pos == "" || pos == "-" {
+		return token.Position{}
+	}
+	var p token.Position
+	parts := strings.Split(pos, ":")
+	// file names may contain colons, so the line and column are taken from the end
+	var nums []int
+	for len(nums) < 2 && len(parts) > 1 {
+		n, err := strconv.Atoi(parts[len(parts)-1])
+		if err != nil {
+			break
+		}
+		nums = append([]int{n}, nums...)
+		parts = parts[:len(parts)-1]
+	}
+	if len(nums) > 0 {
+		p.Line = nums[0]
+	}
+	if len(nums) > 1 {
+		p.Column = nums[1]
+	}
+	p.Filename = strings.Join(parts, ":")
+	if rel, err := filepath.Rel(root, p.Filename); err == nil && !strings.HasPrefix(rel, "..") {
+		if !s.modules {
+			rel = strings.TrimPrefix(filepath.ToSlash(rel), path.Join("src", s.destination)+"/")
+		}
+		p.Filename = filepath.Join(s.dir, rel)
+	}
+	return p
+}
+
+// mutatorName returns the name of the type of a mutator, e.g. "forky.ModifyStrings".
+func mutatorName(m Mutator) string {
+	for {
+		switch w := m.(type) {
+		case concurrent:
+			m = w.Mutator
+			continue
+		case expecting:
+			m = w.Mutator
+			continue
+		}
+		break
+	}
+	t := reflect.TypeOf(m)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.String()
+}
@@ -0,0 +1,51 @@
+package forky
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/dstutil"
+)
+
+func TestErrors(t *testing.T) {
+	files := map[string]string{
+		"a/a.go": "package a\n\nfunc A() {\n\tvar x int = \"a\"\n\t_ = x\n}\n",
+		"b/b.go": "package b\n\nfunc B() {\n",
+		"c/c.go": "package c\n\nvar C = 1\n",
+	}
+	s := newTestSession(t, files)
+
+	err := s.Run([]Mutator{
+		Manual(func(relpath, fname string) func(c *dstutil.Cursor) bool {
+			return func(c *dstutil.Cursor) bool {
+				if id, ok := c.Node().(*dst.Ident); ok && id.Name == "C" {
+					s.Errorf(relpath, fname, id, "found %s", id.Name)
+				}
+				return true
+			}
+		}),
+		Libify{Packages: []string{"a"}},
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	list, ok := err.(ErrorList)
+	if !ok {
+		t.Fatalf("expected ErrorList, got %T: %v", err, err)
+	}
+
+	expected := [][2]string{
+		{"/a/a.go:4:14: forky.Libify: ", "cannot use"},
+		{"/b/b.go:", "expected '}'"},
+		{"/c/c.go:3:5: forky.Manual: ", "found C"},
+	}
+	if len(list) != len(expected) {
+		t.Fatalf("expected %d errors, got %d:\n%v", len(expected), len(list), list)
+	}
+	for i, e := range list {
+		if !strings.HasPrefix(e.Error(), expected[i][0]) || !strings.Contains(e.Error(), expected[i][1]) {
+			t.Fatalf("error %d: expected %q ... %q, got %q", i, expected[i][0], expected[i][1], e.Error())
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package forky
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Expect is the number of times a mutator, or an entry in it (e.g. a TestSkip), is expected to
+// match, so entries that have gone stale after the source is updated are reported. There's no
+// maximum if Max is nil.
+type Expect struct {
+	Min int  `yaml:"min"`
+	Max *int `yaml:"max"`
+}
+
+// AtLeast expects n or more matches.
+func AtLeast(n int) *Expect {
+	return &Expect{Min: n}
+}
+
+// Exactly expects n matches.
+func Exactly(n int) *Expect {
+	return &Expect{Min: n, Max: &n}
+}
+
+func (e *Expect) check(matches int) error {
+	if matches >= e.Min && (e.Max == nil || matches <= *e.Max) {
+		return nil
+	}
+	var expected string
+	switch {
+	case e.Max == nil:
+		expected = fmt.Sprintf("at least %d", e.Min)
+	case e.Min == *e.Max:
+		expected = fmt.Sprintf("exactly %d", e.Min)
+	default:
+		expected = fmt.Sprintf("%d to %d", e.Min, *e.Max)
+	}
+	plural := "es"
+	if e.Min == 1 && (e.Max == nil || *e.Max == 1) {
+		plural = ""
+	}
+	return fmt.Errorf("expected %s match%s, found %d", expected, plural, matches)
+}
+
+// Expecting sets the expected number of matches of a mutator, as counted by Session.Match with an
+// empty key. DeleteNodes counts the nodes it deletes, TestSkipper the funcs it skips, and Manual and
+// Typed the nodes their cursor functions replace, delete or insert.
+func Expecting(m Mutator, e *Expect) Mutator {
+	return expecting{m, e}
+}
+
+type expecting struct {
+	Mutator
+	expect *Expect
+}
+
+func (m expecting) Apply(s *Session) Applier {
+	a := m.Mutator.Apply(s)
+	expect := map[string]*Expect{"": m.expect}
+	for key, e := range a.Expect {
+		if key != "" {
+			expect[key] = e
+		}
+	}
+	a.Expect = expect
+	return a
+}
+
+// Match counts a match of key for the expectations of the mutator being applied (see
+// Applier.Expect). It may be called concurrently by appliers.
+func (s *Session) Match(key string) {
+	s.matchesm.Lock()
+	defer s.matchesm.Unlock()
+	s.matches[key]++
+}
+
+// checkExpect reports the expectations of a mutator that weren't met: as errors, or as warnings if
+// WarnStale is set.
+func (s *Session) checkExpect(expect map[string]*Expect) {
+	var keys []string
+	for key := range expect {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if expect[key] == nil {
+			continue
+		}
+		err := expect[key].check(s.matches[key])
+		if err == nil {
+			continue
+		}
+		if key != "" {
+			err = fmt.Errorf("%s: %v", key, err)
+		}
+		if s.WarnStale {
+			s.events.Warning(&Error{Mutator: s.mutator, Err: err})
+		} else {
+			s.report(err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package forky
+
+import (
+	"bytes"
+	"go/token"
+	"strings"
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/dstutil"
+)
+
+func TestExpect(t *testing.T) {
+	run := func(warn bool, mutators ...Mutator) (error, string) {
+		s := newTestSession(t, map[string]string{
+			"a/a.go":      "package a\n\nvar A, B, C = 1, 2, 3\n",
+			"a/a_test.go": "package a\n\nfunc TestA(t *T) {}\n\nfunc TestB(t *T) {}\n",
+		})
+		buf := &bytes.Buffer{}
+		s.Observer = NewTextObserver(buf)
+		s.WarnStale = warn
+		return s.Run(mutators), buf.String()
+	}
+	skipper := TestSkipper{
+		{Path: "a", Name: "TestA", Expect: AtLeast(1)},
+		{Path: "a", Name: "Test.", Regexp: true, Expect: Exactly(2)},
+		{Path: "a", Name: "TestC", Expect: AtLeast(1)},
+		{Path: "a", Name: "TestD"},
+	}
+	deleteInts := DeleteNodes(func(relpath, fname string, node, parent dst.Node) bool {
+		lit, ok := node.(*dst.BasicLit)
+		return ok && lit.Kind == token.INT && lit.Value != "1"
+	})
+
+	// the nodes replaced by Manual and Typed mutators are counted
+	replaceTwo := Manual(func(relpath, fname string) func(c *dstutil.Cursor) bool {
+		return func(c *dstutil.Cursor) bool {
+			if lit, ok := c.Node().(*dst.BasicLit); ok && lit.Value == "2" {
+				c.Replace(&dst.BasicLit{Kind: token.INT, Value: "4"})
+			}
+			return true
+		}
+	})
+
+	if err, _ := run(false,
+		Expecting(replaceTwo, Exactly(1)),
+		Expecting(deleteInts, AtLeast(2)),
+		Expecting(TestSkipper{{Path: "a", Name: "TestA"}}, Exactly(1)),
+		Expecting(TestSkipper{{Path: "a", Name: "TestZ"}}, Exactly(0)),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	err, _ := run(false, skipper, Expecting(replaceTwo, Exactly(0)), Expecting(deleteInts, Exactly(3)))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	expected := []string{
+		"forky.TestSkipper: a Test.: expected exactly 2 matches, found 1",
+		"forky.TestSkipper: a TestC: expected at least 1 match, found 0",
+		"forky.Manual: expected exactly 0 matches, found 1",
+		"forky.DeleteNodes: expected exactly 3 matches, found 2",
+	}
+	errs, ok := err.(ErrorList)
+	if !ok || len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, found %v", len(expected), err)
+	}
+	for i, e := range errs {
+		if e.Error() != expected[i] {
+			t.Fatalf("expected %q, found %q", expected[i], e.Error())
+		}
+	}
+
+	err, out := run(true, skipper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "a TestC: expected at least 1 match, found 0") {
+		t.Fatalf("expected warning, found %q", out)
+	}
+}
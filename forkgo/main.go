@@ -1,11 +1,17 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"go/build"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/dave/dst"
+	"github.com/dave/dst/dstutil"
 	"github.com/dave/forky"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
 )
 
 const sourceDir = "/Users/dave/src-tmp/go.googlesource.com/go"
@@ -13,25 +19,53 @@ const sourcePath = "go.googlesource.com/go"
 const destinationPath = "github.com/dave/golib"
 const pathPrefix = destinationPath + "/src/"
 
+var diff = flag.Bool("diff", false, "print a diff of the changes to stdout instead of saving")
+var jsonEvents = flag.Bool("json", false, "write progress and events to stderr as JSON lines")
+var branch = flag.String("branch", "", "save the output as a commit on this branch of the destination git repository, instead of to the working copy")
+var author = flag.String("author", "forky <forky@localhost>", "author of the commit when saving to a branch")
+var force = flag.Bool("force", false, "overwrite files in the destination that weren't created by forky, or commit to the checked out branch")
+var revision = flag.String("rev", "", "read the source from this revision of the git repository in the source dir, instead of the working copy")
+
 func main() {
+	flag.Parse()
 	if err := run(); err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 }
 
 func run() error {
 	s := forky.NewSession(sourceDir, sourcePath, destinationPath)
+	if *jsonEvents {
+		s.Observer = forky.NewJSONObserver(os.Stderr)
+	}
+	s.Force = *force
+	if *revision != "" {
+		if err := s.ReadGit(sourceDir, *revision); err != nil {
+			return err
+		}
+	}
 
 	s.ParseFilter = func(relpath string, file os.FileInfo) bool {
-		if strings.Contains(relpath, "/testdata/") || strings.HasSuffix(relpath, "/testdata") {
-			return false
-		}
-		return strings.HasPrefix(relpath, "src/")
+		return forky.MatchPath(relpath, "src/**", "!**/testdata", "!**/testdata/**")
 	}
 
 	if err := s.Run(Default); err != nil {
 		return err
 	}
+	if *diff {
+		return s.Diff(os.Stdout)
+	}
+	if *branch != "" {
+		sig := object.Signature{}
+		sig.Decode([]byte(*author))
+		hash, err := s.SaveGit(filepath.Join(build.Default.GOPATH, "src", destinationPath), *branch, sig)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("saved %s to %s\n", hash, *branch)
+		return nil
+	}
 	if err := s.Save(); err != nil {
 		return err
 	}
@@ -72,37 +106,48 @@ var Default = []forky.Mutator{
 			"cmd/internal",
 			"cmd/link",
 		},
+		Extras: func(relpath, fname string) bool {
+			// testdata and ignored go files, and assembly
+			return strings.HasSuffix(fname, ".go") || strings.HasSuffix(fname, ".s")
+		},
 	},
 	forky.TestSkipper{
-		forky.TestSkip{"src/cmd/internal/obj/arm64", "TestNoRet", "TODO: Enable when go1.11 released"},
-		forky.TestSkip{"src/cmd/internal/obj/arm64", "TestLarge", "TODO: Enable when go1.11 released"},
+		{Path: "src/cmd/internal/obj/arm64", Name: "TestNoRet", Comment: "TODO: Enable when go1.11 released", Expect: forky.Exactly(1)},
+		{Path: "src/cmd/internal/obj/arm64", Name: "TestLarge", Comment: "TODO: Enable when go1.11 released", Expect: forky.Exactly(1)},
 
-		forky.TestSkip{"src/cmd/link/internal/ld", "TestVarDeclCoordsWithLineDirective", "TODO: Enable when go1.11 released"},
-		forky.TestSkip{"src/cmd/link/internal/ld", "TestRuntimeTypeAttr", "TODO: Enable when go1.11 released"},
-		forky.TestSkip{"src/cmd/link/internal/ld", "TestUndefinedRelocErrors", "TODO: Enable when go1.11 released"},
+		{Path: "src/cmd/link/internal/ld", Name: "TestVarDeclCoordsWithLineDirective", Comment: "TODO: Enable when go1.11 released", Expect: forky.Exactly(1)},
+		{Path: "src/cmd/link/internal/ld", Name: "TestRuntimeTypeAttr", Comment: "TODO: Enable when go1.11 released", Expect: forky.Exactly(1)},
+		{Path: "src/cmd/link/internal/ld", Name: "TestUndefinedRelocErrors", Comment: "TODO: Enable when go1.11 released", Expect: forky.Exactly(1)},
 
-		forky.TestSkip{"src/cmd/link", "TestDWARF", "TODO: ???"},
-		forky.TestSkip{"src/cmd/link", "TestDWARFiOS", "TODO: ???"},
+		{Path: "src/cmd/link", Name: "TestDWARF", Comment: "TODO: ???", Expect: forky.Exactly(1)},
+		{Path: "src/cmd/link", Name: "TestDWARFiOS", Comment: "TODO: ???", Expect: forky.Exactly(1)},
 
-		forky.TestSkip{"src/cmd/compile/internal/gc", "TestEmptyDwarfRanges", "TODO: ???"},
-		forky.TestSkip{"src/cmd/compile/internal/gc", "TestIntendedInlining", "TODO: ???"},
+		{Path: "src/cmd/compile/internal/gc", Name: "TestEmptyDwarfRanges", Comment: "TODO: ???", Expect: forky.Exactly(1)},
+		{Path: "src/cmd/compile/internal/gc", Name: "TestIntendedInlining", Comment: "TODO: ???", Expect: forky.Exactly(1)},
 
-		forky.TestSkip{"src/cmd/compile/internal/syntax", "TestStdLib", "TODO: ???"},
+		{Path: "src/cmd/compile/internal/syntax", Name: "TestStdLib", Comment: "TODO: ???", Expect: forky.Exactly(1)},
 
-		forky.TestSkip{"src/cmd/compile/internal/gc", "TestBuiltin", "TODO: I think this is failing because we're stripping comments from the AST?"},
+		{Path: "src/cmd/compile/internal/gc", Name: "TestBuiltin", Comment: "TODO: I think this is failing because we're stripping comments from the AST?", Expect: forky.Exactly(1)},
 	},
-	forky.DeleteNodes(func(relpath, fname string, node, parent dst.Node) bool {
-		// Delete `case macho.CpuArm64` clause in objfile/macho.go
-		// TODO: I think this can be reverted after go1.11 is in use.
-		if cc, ok := node.(*dst.CaseClause); ok && len(cc.List) > 0 {
-			if se, ok := cc.List[0].(*dst.SelectorExpr); ok && se.Sel.Name == "CpuArm64" {
-				if x, ok := se.X.(*dst.Ident); ok && x.Name == "macho" {
-					return true
+	forky.Expecting(forky.Concurrent(forky.Typed(func(relpath, fname string, pkg *forky.PackageInfo) func(c *dstutil.Cursor) bool {
+		if pkg.Info == nil {
+			return nil
+		}
+		return func(c *dstutil.Cursor) bool {
+			// Delete `case macho.CpuArm64` clause in objfile/macho.go
+			// TODO: I think this can be reverted after go1.11 is in use.
+			if cc, ok := c.Node().(*dst.CaseClause); ok && len(cc.List) > 0 {
+				if id, ok := cc.List[0].(*dst.Ident); ok {
+					obj := pkg.Info.Uses[pkg.NodesAst.Ident(id)]
+					if obj != nil && obj.Pkg() != nil && obj.Pkg().Name() == "macho" && obj.Name() == "CpuArm64" {
+						c.Delete()
+						return false
+					}
 				}
 			}
+			return true
 		}
-		return false
-	}),
+	})), forky.Exactly(1)),
 
 	// All tests pass now!
 
@@ -111,5 +156,18 @@ var Default = []forky.Mutator{
 			"src/cmd/compile",
 			"src/cmd/link",
 		},
+		Platforms: []forky.Platform{
+			{GOOS: "linux", GOARCH: "amd64"},
+			{GOOS: "linux", GOARCH: "386"},
+			{GOOS: "linux", GOARCH: "arm"},
+			{GOOS: "linux", GOARCH: "arm64"},
+			{GOOS: "linux", GOARCH: "mips"},
+			{GOOS: "linux", GOARCH: "mips64"},
+			{GOOS: "linux", GOARCH: "ppc64le"},
+			{GOOS: "linux", GOARCH: "s390x"},
+			{GOOS: "darwin", GOARCH: "amd64"},
+			{GOOS: "windows", GOARCH: "amd64"},
+			{GOOS: "js", GOARCH: "wasm"},
+		},
 	},
 }
@@ -2,81 +2,136 @@ package forky
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"go/ast"
 	"go/build"
 	"go/parser"
+	"go/scanner"
 	"go/token"
+	"go/types"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
-
-	"github.com/dave/dst/decorator/resolver"
-
-	"github.com/dave/dst/decorator/resolver/gotypes"
+	"sync"
+	"unicode/utf8"
 
 	"github.com/dave/dst"
 	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/decorator/resolver/gotypes"
 	"github.com/dave/dst/dstutil"
 	"github.com/dave/services/fsutil"
-	"golang.org/x/tools/go/loader"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/tools/go/packages"
 	"gopkg.in/src-d/go-billy.v4"
-	"gopkg.in/src-d/go-billy.v4/helper/mount"
-	"gopkg.in/src-d/go-billy.v4/helper/polyfill"
 	"gopkg.in/src-d/go-billy.v4/memfs"
 	"gopkg.in/src-d/go-billy.v4/osfs"
 )
 
 type Session struct {
 	fs                  billy.Filesystem
-	gorootfs            billy.Filesystem
+	srcfs               billy.Filesystem // filesystem the source is read from - fs if nil
+	revision            string           // git revision of the source (see ReadGit)
+	applied             []string         // names of the mutators applied by Run
 	fset                *token.FileSet
 	dir                 string               // source dir
 	source, destination string               // root path of source and destination
 	paths               map[string]*PathInfo // relative path from root -> path info (may include several packages)
 	gopathsrc           string
-	out                 io.Writer
-	ParseFilter         func(relpath string, file os.FileInfo) bool
-	prog                *loader.Program
+	outdir              string        // output dir (module mode)
+	modules             bool          // source is a go module
+	modfile             *modfile.File // source go.mod (module mode)
+	Observer            Observer      // receives progress and events - defaults to a TextObserver on stdout
+	events              *observer
+	ParseFilter         func(relpath string, file os.FileInfo) bool // may be called concurrently for different dirs
+	Workers             int                                         // number of goroutines used for parsing and concurrent appliers
+	pkgs                []*packages.Package
+	pkgNames            map[string]string  // package path -> name, for the packages in pkgs
+	buildNames          map[string]string  // package path -> name, for packages found in GOROOT or GOPATH ("" if not found)
+	namesm              sync.Mutex         // protects buildNames
+	errs                ErrorList          // errors reported during Run
+	errsm               sync.Mutex         // protects errs
+	mutator             string             // name of the mutator being applied
+	modified            map[string]bool    // files modified in place by the applier being run (see Modified)
+	modifiedm           sync.Mutex         // protects modified
+	typed               bool               // type information in paths is up to date
+	managed             map[*dst.File]bool // files decorated with import management by a type check
+	Force               bool               // Save may overwrite files in the destination that it didn't create, and SaveGit may commit to the checked out branch
+	WarnStale           bool               // report unmet expectations (see Expect) as warnings rather than errors
+	AutoCleanup         *Cleanup           // applied after the mutators in every Run, if set
+	matches             map[string]int     // matches counted by the mutator being applied
+	matchesm            sync.Mutex         // protects matches
 }
 
 func NewSession(dir, source, destination string) *Session {
-	return &Session{
+	s := &Session{
 		fs:          osfs.New("/"),
-		gorootfs:    polyfill.New(mount.New(memfs.New(), "/goroot", osfs.New(build.Default.GOROOT))),
 		gopathsrc:   filepath.Join(build.Default.GOPATH, "src"),
 		fset:        token.NewFileSet(),
 		dir:         dir,
 		source:      source,
 		destination: destination,
 		paths:       map[string]*PathInfo{},
-		out:         os.Stdout,
+		managed:     map[*dst.File]bool{},
+		Observer:    NewTextObserver(os.Stdout),
+		Workers:     runtime.NumCPU(),
 	}
+	s.events = &observer{s: s}
+	return s
 }
 
+// Run applies the mutations. Errors reported by the mutators or found while parsing don't stop the
+// run - they are collected and returned together as an ErrorList.
 func (s *Session) Run(mutations []Mutator) error {
 
+	s.errs = nil
+
+	if s.modules && s.modfile == nil {
+		if err := s.readModFile(); err != nil {
+			return err
+		}
+	}
+
+	if s.AutoCleanup != nil {
+		mutations = append(mutations[:len(mutations):len(mutations)], *s.AutoCleanup)
+	}
+
 	var appliers []Applier
+	var names []string
 	for _, mutation := range mutations {
 		appliers = append(appliers, mutation.Apply(s))
+		names = append(names, mutatorName(mutation))
 	}
+	s.applied = append(s.applied, names...)
 
 	files, err := s.getFiles()
 	if err != nil {
 		return err
 	}
 
+	// signatures of assembly backed functions, to check after each mutator
+	var asm []asmFunc
+	var scanned bool
+
 	for i, applier := range appliers {
+		s.matches = map[string]int{}
+
 		if applier.FileFilter != nil {
-			var count int
+			phase := fmt.Sprintf("Filtering (%d/%d)", i+1, len(appliers))
+			s.events.PhaseStart(phase, len(files))
+			var count, deleted int
 			for relpath := range files {
 
 				count++
-				fmt.Fprintf(s.out, "\rFiltering (%d/%d): %d/%d", i+1, len(appliers), count, len(files))
+				s.events.Progress(phase, relpath, count, len(files))
 
 				for fname := range files[relpath] {
 
@@ -87,6 +142,7 @@ func (s *Session) Run(mutations []Mutator) error {
 
 					// Delete file
 					delete(files[relpath], fname)
+					deleted++
 
 					// If path info does not exist - not parsed yet, so continue
 					if s.paths[relpath] == nil {
@@ -96,6 +152,7 @@ func (s *Session) Run(mutations []Mutator) error {
 					// If file is in extras, no need to search for it in packages
 					if s.paths[relpath].Extras[fname] {
 						delete(s.paths[relpath].Extras, fname)
+						delete(s.paths[relpath].Contents, fname)
 						continue
 					}
 
@@ -110,40 +167,77 @@ func (s *Session) Run(mutations []Mutator) error {
 					}
 				}
 			}
+			s.events.PhaseEnd(phase)
+			s.events.Changed(names[i], deleted)
+			if deleted > 0 {
+				s.typed = false
+			}
 		}
 
-		if (applier.Apply != nil || applier.Func != nil) && len(s.paths) == 0 {
+		if (applier.Apply != nil || applier.ApplyTyped != nil || applier.ApplyText != nil || applier.Func != nil) && len(s.paths) == 0 {
 			// If we haven't parsed yet, parse now.
 			if err := s.parse(files); err != nil {
 				return err
 			}
 		}
 
-		if applier.Apply != nil {
-			var count int
-			for relpath, pathInfo := range s.paths {
-				count++
-				fmt.Fprintf(s.out, "\rApplying (%d/%d): %d/%d", i+1, len(appliers), count, len(s.paths))
-				for _, pkgInfo := range pathInfo.Packages {
-					for fname, file := range pkgInfo.Files {
-						applyFunc := applier.Apply(relpath, fname)
-						if applyFunc == nil {
-							continue
-						}
-						result := dstutil.Apply(file, applyFunc, nil)
-						if result == nil {
-							pkgInfo.Files[fname] = nil
-						} else {
-							pkgInfo.Files[fname] = result.(*dst.File)
-						}
-					}
+		if !scanned && len(s.paths) > 0 {
+			asm = s.asmFuncs()
+			scanned = true
+		}
+
+		s.mutator = names[i]
+
+		if applier.ApplyTyped != nil && !s.typed {
+			// Type check lazily, only when the files have changed since the last type check. If the
+			// files don't type check, the errors are reported and the applier is skipped.
+			if err := s.load(); err != nil {
+				s.report(err)
+				s.mutator = ""
+				continue
+			}
+			s.typed = true
+		}
+
+		if applier.Apply != nil || applier.ApplyTyped != nil || applier.ApplyText != nil {
+			var changed int
+			if applier.Apply != nil || applier.ApplyTyped != nil {
+				phase := fmt.Sprintf("Applying (%d/%d)", i+1, len(appliers))
+				n, err := s.apply(applier, phase)
+				if err != nil {
+					return err
+				}
+				if n > 0 {
+					s.typed = false
+				}
+				changed += n
+			}
+			if applier.ApplyText != nil {
+				phase := fmt.Sprintf("Applying to extras (%d/%d)", i+1, len(appliers))
+				n, err := s.applyText(applier, phase)
+				if err != nil {
+					return err
 				}
+				changed += n
 			}
+			s.events.Changed(names[i], changed)
 		}
 
 		if applier.Func != nil {
+			phase := fmt.Sprintf("Running %s (%d/%d)", names[i], i+1, len(appliers))
+			s.events.PhaseStart(phase, 0)
 			applier.Func()
+			s.events.PhaseEnd(phase)
+			s.typed = false
+		}
+
+		if scanned && (applier.Apply != nil || applier.ApplyTyped != nil || applier.Func != nil) {
+			asm = s.checkAsm(asm)
 		}
+
+		s.checkExpect(applier.Expect)
+
+		s.mutator = ""
 	}
 
 	// If we haven't parsed yet, parse now.
@@ -153,14 +247,210 @@ func (s *Session) Run(mutations []Mutator) error {
 		}
 	}
 
+	if len(s.errs) > 0 {
+		s.errs.Sort()
+		return s.errs
+	}
+
 	return nil
 }
 
+// apply runs the cursor function of an applier on every go file, and returns the number of files
+// that were changed or deleted. Files are visited in a fixed order, and appliers marked as
+// Concurrent are run on a pool of s.Workers goroutines.
+func (s *Session) apply(applier Applier, phase string) (int, error) {
+	type job struct {
+		relpath, fname string
+		pkg            *PackageInfo
+	}
+	var jobs []job
+	for _, relpath := range s.relpaths() {
+		pathInfo := s.paths[relpath]
+		var names []string
+		for name := range pathInfo.Packages {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			pkgInfo := pathInfo.Packages[name]
+			var fnames []string
+			for fname := range pkgInfo.Files {
+				fnames = append(fnames, fname)
+			}
+			sort.Strings(fnames)
+			for _, fname := range fnames {
+				jobs = append(jobs, job{relpath: relpath, fname: fname, pkg: pkgInfo})
+			}
+		}
+	}
+
+	workers := 1
+	if applier.Concurrent {
+		workers = s.Workers
+	}
+
+	// results are stored by job and copied to the packages afterwards, so the Files maps are not
+	// written to concurrently.
+	results := make([]*dst.File, len(jobs))
+	edits := make([]int, len(jobs))
+	s.modified = map[string]bool{}
+	s.events.PhaseStart(phase, len(jobs))
+	if err := parallel(workers, len(jobs), func(i int) error {
+		j := jobs[i]
+		file := j.pkg.Files[j.fname]
+		results[i] = file
+		var applyFunc func(*dstutil.Cursor) bool
+		if applier.ApplyTyped != nil {
+			pkg := j.pkg
+			if pkg.NodesAst.File(file) == nil {
+				// the file wasn't decorated by the last type check, so the node maps don't cover it
+				pkg = &PackageInfo{Name: pkg.Name, Files: pkg.Files}
+			}
+			applyFunc = applier.ApplyTyped(j.relpath, j.fname, pkg)
+		} else {
+			applyFunc = applier.Apply(j.relpath, j.fname)
+		}
+		if applyFunc == nil {
+			return nil
+		}
+		result := dstutil.Apply(file, trackEdits(applyFunc, &edits[i], applier.MatchEdits), nil)
+		if result == nil {
+			results[i] = nil
+			edits[i]++
+		} else {
+			results[i] = result.(*dst.File)
+		}
+		return nil
+	}, func(i, done int) {
+		s.events.Progress(phase, path.Join(jobs[i].relpath, jobs[i].fname), done, len(jobs))
+	}); err != nil {
+		return 0, err
+	}
+	s.events.PhaseEnd(phase)
+
+	var count int
+	for i, j := range jobs {
+		if s.managed[j.pkg.Files[j.fname]] && results[i] != nil {
+			s.managed[results[i]] = true
+		}
+		j.pkg.Files[j.fname] = results[i]
+		if edits[i] > 0 || s.modified[path.Join(j.relpath, j.fname)] {
+			count++
+		}
+		if applier.MatchEdits {
+			s.matches[""] += edits[i]
+		}
+	}
+	return count, nil
+}
+
+// trackEdits wraps a cursor function, and counts the calls that replace, delete or insert nodes in
+// *edits. Unless all is set, it stops checking after the first edit. The cursor doesn't see changes
+// made to nodes in place, so they are reported with Modified.
+func trackEdits(f func(*dstutil.Cursor) bool, edits *int, all bool) func(*dstutil.Cursor) bool {
+	return func(c *dstutil.Cursor) bool {
+		if *edits > 0 && !all {
+			return f(c)
+		}
+		node, index, length := c.Node(), c.Index(), cursorLen(c)
+		cont := f(c)
+		if c.Index() != index || cursorLen(c) != length || !cursorAt(c, node) {
+			*edits++
+		}
+		return cont
+	}
+}
+
+// cursorLen returns the length of the slice containing the node of a cursor, or -1 if the node
+// isn't in a slice.
+func cursorLen(c *dstutil.Cursor) int {
+	if c.Index() < 0 {
+		return -1
+	}
+	return reflect.Indirect(reflect.ValueOf(c.Parent())).FieldByName(c.Name()).Len()
+}
+
+// cursorAt reports whether the field of the parent at the cursor still holds node.
+func cursorAt(c *dstutil.Cursor, node dst.Node) bool {
+	v := reflect.Indirect(reflect.ValueOf(c.Parent())).FieldByName(c.Name())
+	if i := c.Index(); i >= 0 {
+		if i >= v.Len() {
+			return false
+		}
+		v = v.Index(i)
+	}
+	if node == nil {
+		return v.IsNil()
+	}
+	return v.Interface() == node
+}
+
+// Modified records that a cursor function changed a node of a file in place, so the file is
+// counted as changed by the applier. Replacing, deleting and inserting nodes with the cursor is
+// tracked automatically. It may be called concurrently by appliers.
+func (s *Session) Modified(relpath, fname string) {
+	s.modifiedm.Lock()
+	defer s.modifiedm.Unlock()
+	s.modified[path.Join(relpath, fname)] = true
+}
+
+// printFile returns the source of a file in relpath, or nil if it can't be printed.
+func (s *Session) printFile(relpath string, file *dst.File) []byte {
+	buf := &bytes.Buffer{}
+	if err := s.fprint(buf, relpath, file); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// srcFS returns the filesystem the source is read from.
+func (s *Session) srcFS() billy.Filesystem {
+	if s.srcfs != nil {
+		return s.srcfs
+	}
+	return s.fs
+}
+
+// relpaths returns the relative paths of all parsed dirs in order.
+func (s *Session) relpaths() []string {
+	var relpaths []string
+	for relpath := range s.paths {
+		relpaths = append(relpaths, relpath)
+	}
+	sort.Strings(relpaths)
+	return relpaths
+}
+
+// Stats counts the dirs, packages and files in the session.
+type Stats struct {
+	Dirs, Packages int
+	Files          int // go files in packages
+	Extras         int // other files
+}
+
+// Stats returns the number of dirs, packages and files in the output of the session.
+func (s *Session) Stats() Stats {
+	var st Stats
+	for _, info := range s.paths {
+		st.Dirs++
+		st.Packages += len(info.Packages)
+		st.Extras += len(info.Extras)
+		for _, pkg := range info.Packages {
+			for _, file := range pkg.Files {
+				if file != nil {
+					st.Files++
+				}
+			}
+		}
+	}
+	return st
+}
+
 func (s *Session) getFiles() (map[string]map[string]bool, error) {
 	// make list of files by relpath
 	files := map[string]map[string]bool{} // full file path -> true
 
-	if err := fsutil.Walk(s.fs, s.dir, func(fs billy.Filesystem, fpath string, finfo os.FileInfo, err error) error {
+	if err := fsutil.Walk(s.srcFS(), s.dir, func(fs billy.Filesystem, fpath string, finfo os.FileInfo, err error) error {
 		if finfo == nil {
 			return nil
 		}
@@ -185,103 +475,144 @@ func (s *Session) getFiles() (map[string]map[string]bool, error) {
 
 func (s *Session) parse(files map[string]map[string]bool) error {
 
-	var count int
+	var relpaths []string
 	for relpath := range files {
+		relpaths = append(relpaths, relpath)
+	}
+	sort.Strings(relpaths)
+
+	infos := make([]*PathInfo, len(relpaths))
+	syntax := make([]ErrorList, len(relpaths))
+	s.events.PhaseStart("Parsing", len(relpaths))
+	if err := parallel(s.Workers, len(relpaths), func(i int) error {
+		info, errs, err := s.parsePath(relpaths[i], files[relpaths[i]])
+		infos[i] = info
+		syntax[i] = errs
+		return err
+	}, func(i, done int) {
+		s.events.Progress("Parsing", relpaths[i], done, len(relpaths))
+	}); err != nil {
+		return err
+	}
+	s.events.PhaseEnd("Parsing")
 
-		count++
-		fmt.Fprintf(s.out, "\rParsing: %d/%d", count, len(files))
+	for i, relpath := range relpaths {
+		s.paths[relpath] = infos[i]
+		if len(syntax[i]) > 0 {
+			s.report(syntax[i])
+		}
+	}
+	return nil
+}
 
-		dir := filepath.Join(s.dir, relpath)
-		pkg := dirToPath(filepath.Join(s.source, relpath))
+// parsePath parses the files in a directory. It is called concurrently for different directories.
+// Files with syntax errors are left out, and the errors are returned in the ErrorList.
+func (s *Session) parsePath(relpath string, files map[string]bool) (*PathInfo, ErrorList, error) {
 
-		info := &PathInfo{
-			Dir:      dir,
-			Path:     pkg,
-			Relpath:  relpath,
-			Packages: map[string]*PackageInfo{},
-			Extras:   map[string]bool{},
-		}
-		s.paths[relpath] = info
+	dir := filepath.Join(s.dir, relpath)
+	pkg := dirToPath(filepath.Join(s.source, relpath))
 
-		filter := func(file os.FileInfo) bool {
-			if !files[relpath][file.Name()] {
-				// file has already been filtered
-				return false
-			}
-			if s.ParseFilter != nil && !s.ParseFilter(relpath, file) {
-				return false
-			}
-			return true
-		}
+	info := &PathInfo{
+		Dir:      dir,
+		Path:     pkg,
+		Relpath:  relpath,
+		Packages: map[string]*PackageInfo{},
+		Extras:   map[string]bool{},
+		Contents: map[string][]byte{},
+	}
 
-		dstpackages, dstnodes, err := parseDir(s.fs, s.fset, dir, filter, parser.ParseComments)
-		if err != nil {
-			return err
+	filter := func(file os.FileInfo) bool {
+		if !files[file.Name()] {
+			// file has already been filtered
+			return false
 		}
-
-		astnodes := map[dst.Node]ast.Node{}
-		for k, v := range dstnodes {
-			astnodes[v] = k
+		if s.ParseFilter != nil && !s.ParseFilter(relpath, file) {
+			return false
 		}
+		return true
+	}
 
-		info.NodesAst = astnodes
-		info.NodesDst = dstnodes
+	dstpackages, dstnodes, syntax, err := parseDir(s.srcFS(), s.fset, dir, filter, parser.ParseComments)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		var name string
-		packages := map[string]*PackageInfo{} // package name -> file name -> ast file
-		var hasFiles bool
-		for pkgname, pkg := range dstpackages {
-			packages[pkgname] = &PackageInfo{Name: pkgname, Files: map[string]*dst.File{}, NodesDst: dstnodes, NodesAst: astnodes}
-			if strings.HasSuffix(pkgname, "_test") {
-				if name == "" {
-					name = pkgname // only set name to x_test if it doesn't already have a value
-				}
-			} else if pkgname == "main" {
-				if name == "" || strings.HasSuffix(pkgname, "_test") {
-					name = pkgname // only set name to main if it doesn't already have a value, or is a test package
-				}
-			} else {
-				name = pkgname
-			}
+	astnodes := map[dst.Node]ast.Node{}
+	for k, v := range dstnodes {
+		astnodes[v] = k
+	}
 
-			for fpath, file := range pkg.Files {
-				hasFiles = true
-				_, fname := filepath.Split(fpath)
-				packages[pkgname].Files[fname] = file
-			}
+	info.NodesAst = astnodes
+	info.NodesDst = dstnodes
+
+	packages := map[string]*PackageInfo{} // package name -> file name -> ast file
+	var hasFiles bool
+	for pkgname, pkg := range dstpackages {
+		packages[pkgname] = &PackageInfo{Name: pkgname, Files: map[string]*dst.File{}, NodesDst: dstnodes, NodesAst: astnodes}
+		for fpath, file := range pkg.Files {
+			hasFiles = true
+			_, fname := filepath.Split(fpath)
+			packages[pkgname].Files[fname] = file
 		}
-		if name == "" && hasFiles {
-			panic("no name for " + relpath)
+	}
+	info.Packages = packages
+
+	name := defaultName(info)
+	if name == "" && hasFiles {
+		return nil, nil, fmt.Errorf("no name for %s", relpath)
+	}
+	if name != "" {
+		info.Default = packages[name]
+	}
+
+	// build a list of all the parsed files
+	gofiles := map[string]bool{}
+	for _, files := range packages {
+		for fname := range files.Files {
+			gofiles[fname] = true
 		}
-		if name != "" {
-			info.Default = packages[name]
+	}
+
+	// any files in the dir that have not been parsed, add to the extras collection
+	for fname := range files {
+		if !gofiles[fname] {
+			info.Extras[fname] = true
 		}
+	}
 
-		info.Packages = packages
+	return info, syntax, nil
+}
 
-		// build a list of all the parsed files
-		gofiles := map[string]bool{}
-		for _, files := range packages {
-			for fname := range files.Files {
-				gofiles[fname] = true
+// defaultName returns the name of the default package in a dir: the package that isn't main or
+// x_test, then main, then x_test.
+func defaultName(info *PathInfo) string {
+	var names []string
+	for name := range info.Packages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var name string
+	for _, pkgname := range names {
+		switch {
+		case strings.HasSuffix(pkgname, "_test"):
+			if name == "" {
+				name = pkgname
 			}
-		}
-
-		// any files in the dir that have not been parsed, add to the extras collection
-		for fname := range files[relpath] {
-			if !gofiles[fname] {
-				info.Extras[fname] = true
+		case pkgname == "main":
+			if name == "" || strings.HasSuffix(name, "_test") {
+				name = pkgname
 			}
+		default:
+			name = pkgname
 		}
-
 	}
-	return nil
+	return name
 }
 
-func parseDir(fs billy.Filesystem, fset *token.FileSet, dir string, filter func(os.FileInfo) bool, mode parser.Mode) (pkgs map[string]*dst.Package, nodes map[ast.Node]dst.Node, first error) {
+func parseDir(fs billy.Filesystem, fset *token.FileSet, dir string, filter func(os.FileInfo) bool, mode parser.Mode) (pkgs map[string]*dst.Package, nodes map[ast.Node]dst.Node, syntax ErrorList, err error) {
 	list, err := fs.ReadDir(dir)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	pkgs = make(map[string]*dst.Package)
@@ -291,7 +622,7 @@ func parseDir(fs billy.Filesystem, fset *token.FileSet, dir string, filter func(
 			fpath := filepath.Join(dir, d.Name())
 			b, err := readFile(fs, fpath)
 			if err != nil {
-				return nil, nil, err
+				return nil, nil, nil, err
 			}
 			if src, err := parser.ParseFile(fset, fpath, b, mode); err == nil {
 				name := src.Name.Name
@@ -304,23 +635,86 @@ func parseDir(fs billy.Filesystem, fset *token.FileSet, dir string, filter func(
 					pkgs[name] = pkg
 				}
 				pkg.Files[fpath] = dec.DecorateFile(src)
-			} else if first == nil {
-				first = err
+			} else if list, ok := err.(scanner.ErrorList); ok {
+				for _, e := range list {
+					syntax.Add(&Error{Pos: e.Pos, Err: errors.New(e.Msg)})
+				}
+			} else {
+				syntax.Add(&Error{Pos: token.Position{Filename: fpath}, Err: err})
 			}
 		}
 	}
 
-	return pkgs, dec.Dst.Nodes, first
+	return pkgs, dec.Dst.Nodes, syntax, nil
 }
 
-// load the program and scan types
-func (s *Session) load() {
-	// save all files to a memfs
-	gopathfs := memfs.New()
+// load the program and scan types for the host platform. Packages that are not type checked (e.g.
+// external test packages) are left with a nil Info.
+func (s *Session) load() error {
+	infos, pkgs, err := s.typecheck(Platform{}, false)
+	if err != nil {
+		return err
+	}
+	s.pkgs = pkgs
+	s.pkgNames = packageNames(pkgs)
+	for _, info := range s.paths {
+		for _, pkg := range info.Packages {
+			pkg.Info = nil
+		}
+	}
+	for relpath, named := range infos {
+		for name, info := range named {
+			pkg := s.paths[relpath].Packages[name]
+			// files excluded by build constraints keep their current contents
+			for fname, file := range info.Files {
+				pkg.Files[fname] = file
+				s.managed[file] = true
+			}
+			pkg.Info = info.Info
+			pkg.NodesDst = info.NodesDst
+			pkg.NodesAst = info.NodesAst
+		}
+	}
+	return nil
+}
+
+// typecheck type checks the files in the session for a platform, and returns freshly decorated
+// copies of the packages (relpath -> package name -> package info). The session is not modified.
+// Files excluded on the platform by build constraints are not included. If tests is set the test
+// packages are loaded too, but only the packages without tests are returned as infos. Type errors
+// are returned as an ErrorList, along with the loaded packages but no package infos.
+func (s *Session) typecheck(p Platform, tests bool) (map[string]map[string]*PackageInfo, []*packages.Package, error) {
+	// Files are loaded from a temporary root that only exists in the overlay, so files that have
+	// been deleted or filtered during the session are not picked up from disk.
+	root, err := ioutil.TempDir("", "forky")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(root)
+
+	env := os.Environ()
+	if p.GOOS != "" {
+		env = append(env, "GOOS="+p.GOOS)
+	}
+	if p.GOARCH != "" {
+		env = append(env, "GOARCH="+p.GOARCH)
+	}
+	dir := root // dir of the destination root package
+	if s.modules {
+		env = append(env, "GO111MODULE=on", "GOFLAGS=")
+	} else {
+		env = append(env, "GOPATH="+root, "GO111MODULE=off", "GOFLAGS=")
+		dir = filepath.Join(root, "src", s.destination)
+	}
+
+	phase := "Scanning " + p.String()
+	s.events.PhaseStart(phase, len(s.paths))
+	overlay := map[string][]byte{}
 	var count int
-	for relpath, info := range s.paths {
-		fmt.Fprintf(s.out, "\rScanning: %d/%d", count+1, len(s.paths))
+	for _, relpath := range s.relpaths() {
+		info := s.paths[relpath]
 		count++
+		s.events.Progress(phase, relpath, count, len(s.paths))
 		for _, pkg := range info.Packages {
 			for fname, file := range pkg.Files {
 
@@ -328,52 +722,73 @@ func (s *Session) load() {
 					continue
 				}
 
-				rootrelfpath := filepath.Join("gopath", "src", s.destination, relpath, fname)
+				fpath := filepath.Join(dir, relpath, fname)
 
 				buf := &bytes.Buffer{}
-				if err := decorator.Fprint(buf, file); err != nil {
-					panic(fmt.Errorf("format.Node error in %s: %v", rootrelfpath, err))
+				if err := s.fprint(buf, relpath, file); err != nil {
+					return nil, nil, fmt.Errorf("format.Node error in %s: %v", filepath.Join(relpath, fname), err)
 				}
 
-				if err := fsutil.WriteFile(gopathfs, rootrelfpath, 0666, buf); err != nil {
-					panic(err)
-				}
+				overlay[fpath] = buf.Bytes()
 			}
 		}
 	}
+	s.events.PhaseEnd(phase)
 
-	bc := buildContext(s.gorootfs, gopathfs, s.destination)
-	lc := loader.Config{
-		ParserMode: parser.ParseComments,
-		Fset:       s.fset,
-		Build:      bc,
-		Cwd:        "/",
+	if s.modules {
+		// imports outside the destination module are resolved through go.mod
+		modfile, err := s.formatModFile(root)
+		if err != nil {
+			return nil, nil, err
+		}
+		overlay[filepath.Join(root, "go.mod")] = modfile
+		if sum, err := readFile(s.srcFS(), filepath.Join(s.dir, "go.sum")); err == nil {
+			overlay[filepath.Join(root, "go.sum")] = sum
+		}
 	}
+
+	var patterns []string
 	for relpath, pathInfo := range s.paths {
 		if len(pathInfo.Packages) == 0 {
 			continue
 		}
-		lc.Import(path.Join(s.destination, relpath))
+		patterns = append(patterns, path.Join(s.destination, relpath))
+	}
+
+	cfg := &packages.Config{
+		Mode:    loadMode,
+		Dir:     root,
+		Env:     env,
+		Fset:    s.fset,
+		Overlay: overlay,
+		Tests:   tests,
 	}
-	p, err := lc.Load()
+	phase = "Type checking " + p.String()
+	s.events.PhaseStart(phase, 0)
+	pkgs, err := packages.Load(cfg, patterns...)
+	s.events.PhaseEnd(phase)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
-	s.prog = p
-	for pkg, info := range p.AllPackages {
-		relpath := strings.TrimPrefix(pkg.Path(), s.destination+"/")
-		if s.paths[relpath] == nil || s.paths[relpath].Packages[pkg.Name()] == nil {
-			// only update packages that exist in s.paths (in infos we also have std lib etc).
-			continue
+	if errs := s.packageErrors(root, p, pkgs); len(errs) > 0 {
+		return nil, pkgs, errs
+	}
+	infos := map[string]map[string]*PackageInfo{}
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		relpath, ok := s.Rel(pkg.PkgPath)
+		if !ok || pkg.ID != pkg.PkgPath || s.paths[relpath] == nil || s.paths[relpath].Packages[pkg.Name] == nil {
+			// only update packages that exist in s.paths (in pkgs we also have std lib, test
+			// variants etc).
+			return
 		}
 		files := map[string]*dst.File{}
-		dec := decorator.New(p.Fset)
-		dec.Path = pkg.Path()
+		dec := decorator.New(s.fset)
+		dec.Path = pkg.PkgPath
 		dec.Resolver = &gotypes.IdentResolver{
-			Info: &info.Info,
+			Info: pkg.TypesInfo,
 		}
 
-		for _, f := range info.Files {
+		for _, f := range pkg.Syntax {
 			_, fname := filepath.Split(s.fset.File(f.Pos()).Name())
 			file := dec.DecorateFile(f)
 
@@ -397,13 +812,23 @@ func (s *Session) load() {
 
 			files[fname] = file
 		}
-		s.paths[relpath].Packages[pkg.Name()].Files = files
-		s.paths[relpath].Packages[pkg.Name()].Info = info
-		s.paths[relpath].Packages[pkg.Name()].NodesDst = dec.Dst.Nodes
-		s.paths[relpath].Packages[pkg.Name()].NodesAst = dec.Ast.Nodes
-	}
+		if infos[relpath] == nil {
+			infos[relpath] = map[string]*PackageInfo{}
+		}
+		infos[relpath][pkg.Name] = &PackageInfo{
+			Name:     pkg.Name,
+			Files:    files,
+			Info:     &TypesInfo{Pkg: pkg.Types, Info: *pkg.TypesInfo},
+			NodesDst: dec.Dst.Nodes,
+			NodesAst: dec.Ast.Nodes,
+		}
+	})
+	return infos, pkgs, nil
 }
 
+const loadMode = packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles | packages.NeedImports |
+	packages.NeedDeps | packages.NeedTypes | packages.NeedSyntax | packages.NeedTypesInfo
+
 func readFile(fs billy.Filesystem, fpath string) ([]byte, error) {
 	f, err := fs.Open(fpath)
 	if err != nil {
@@ -421,28 +846,33 @@ func (s *Session) Rel(path string) (rel string, found bool) {
 	if s.destination == "" {
 		return path, true
 	}
+	if path == s.destination {
+		return ".", true
+	}
 	if strings.HasPrefix(path, s.destination+"/") {
 		return strings.TrimPrefix(path, s.destination+"/"), true
 	}
 	return "", false
 }
 
-func (s *Session) Save() error {
+// render writes the output to an in-memory filesystem: all go files are printed and extras are
+// copied from the source. dir is where the output will be written, for the relative paths in go.mod.
+func (s *Session) render(phase, dir string) (billy.Filesystem, error) {
 	tempfs := memfs.New()
 
-	destinationDir := filepath.Join(s.gopathsrc, s.destination)
+	s.events.PhaseStart(phase, len(s.paths))
+	defer s.events.PhaseEnd(phase)
 
 	var count int
-	for relpath, pathInfo := range s.paths {
+	for _, relpath := range s.relpaths() {
+		pathInfo := s.paths[relpath]
 
 		count++
-		fmt.Fprintf(s.out, "\rSaving: %d/%d", count, len(s.paths))
+		s.events.Progress(phase, relpath, count, len(s.paths))
 
 		// go packages
 		for _, pkgInfo := range pathInfo.Packages {
-			res := decorator.NewRestorer()
-			res.Path = path.Join(s.destination, pathInfo.Relpath)
-			res.Resolver = &resolver.Guess{} // TODO: can only resolve package names after files are written, so to use gobuild.PackageResolver, we need to order the packages in initialisation order
+			res := s.restorer(pathInfo.Relpath)
 
 			for fname, file := range pkgInfo.Files {
 				if file == nil {
@@ -453,11 +883,11 @@ func (s *Session) Save() error {
 
 				buf := &bytes.Buffer{}
 				if err := res.Fprint(buf, file); err != nil {
-					return fmt.Errorf("decorator.Fprint error in %s: %v", relfpath, err)
+					return nil, fmt.Errorf("decorator.Fprint error in %s: %v", relfpath, err)
 				}
 
 				if err := fsutil.WriteFile(tempfs, relfpath, 0666, buf); err != nil {
-					return err
+					return nil, err
 				}
 			}
 		}
@@ -465,40 +895,43 @@ func (s *Session) Save() error {
 		for fname := range pathInfo.Extras {
 			from := filepath.Join(s.dir, relpath, fname)
 			to := filepath.Join(relpath, fname)
-			if err := fsutil.Copy(tempfs, to, s.fs, from); err != nil {
-				return err
+			if s.modfile != nil && relpath == "." && fname == "go.mod" {
+				// go.mod is rewritten with the destination module path
+				if err := s.writeModFile(tempfs, to, dir); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if b, ok := pathInfo.Contents[fname]; ok {
+				if err := fsutil.WriteFile(tempfs, to, 0666, bytes.NewBuffer(b)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err := fsutil.Copy(tempfs, to, s.srcFS(), from); err != nil {
+				return nil, err
 			}
 		}
 	}
+	return tempfs, nil
+}
 
-	s.fs.MkdirAll(destinationDir, 0777)
-	if err := removeContents(s.fs, destinationDir); err != nil {
-		return err
-	}
-	if err := fsutil.Copy(s.fs, destinationDir, tempfs, "/"); err != nil {
-		return err
-	}
-	return nil
+// restorer returns a restorer with import management for files in relpath.
+func (s *Session) restorer(relpath string) *decorator.Restorer {
+	res := decorator.NewRestorer()
+	res.Path = path.Join(s.destination, relpath)
+	res.Resolver = packageResolver{s: s, relpath: relpath}
+	return res
 }
 
-func removeContents(fs billy.Filesystem, dir string) error {
-	fis, err := fs.ReadDir(dir)
-	if err != nil {
-		return err
+// fprint prints a file in relpath while the session is running. Files decorated by a type check
+// need import management to print qualified identifiers. Other files are printed as they are,
+// because import management would remove their imports.
+func (s *Session) fprint(w io.Writer, relpath string, file *dst.File) error {
+	if s.managed[file] {
+		return s.restorer(relpath).Fprint(w, file)
 	}
-	for _, fi := range fis {
-		fpath := filepath.Join(dir, fi.Name())
-		if fi.IsDir() {
-			if err := removeContents(fs, fpath); err != nil {
-				return err
-			}
-		} else {
-			if err := fs.Remove(fpath); err != nil {
-				return err
-			}
-		}
-	}
-	return nil
+	return decorator.Fprint(w, file)
 }
 
 type Mutator interface {
@@ -512,6 +945,7 @@ type PathInfo struct {
 	Default  *PackageInfo            // default package (e.g. not x_test or main)
 	Packages map[string]*PackageInfo // all named packages in dir - e.g. foo, foo_test, main: package name -> package info
 	Extras   map[string]bool         // filenames of all files not included in packages (non-go files, filtered go files etc.)
+	Contents map[string][]byte       // contents of extras that have been modified by text appliers
 	NodesAst map[dst.Node]ast.Node
 	NodesDst map[ast.Node]dst.Node
 }
@@ -519,11 +953,34 @@ type PathInfo struct {
 type PackageInfo struct {
 	Name     string
 	Files    map[string]*dst.File // file name -> ast file
-	Info     *loader.PackageInfo
+	Info     *TypesInfo
 	NodesDst DstNodeMap
 	NodesAst AstNodeMap
 }
 
+// Platform is a target operating system and architecture for type checking. Empty fields default
+// to the host platform.
+type Platform struct {
+	GOOS, GOARCH string
+}
+
+func (p Platform) String() string {
+	goos, goarch := p.GOOS, p.GOARCH
+	if goos == "" {
+		goos = build.Default.GOOS
+	}
+	if goarch == "" {
+		goarch = build.Default.GOARCH
+	}
+	return goos + "/" + goarch
+}
+
+// TypesInfo is the type checked package and the type information for its files.
+type TypesInfo struct {
+	Pkg *types.Package
+	types.Info
+}
+
 type DstNodeMap map[ast.Node]dst.Node
 
 func (m DstNodeMap) Ident(n *ast.Ident) *dst.Ident {
@@ -591,49 +1048,84 @@ func (m AstNodeMap) File(n *dst.File) *ast.File {
 	return m[n].(*ast.File)
 }
 
+// TestSkipper skips tests, benchmarks, fuzz tests and subtests (run with a string literal name, e.g.
+// t.Run("foo", ...)) by adding a call to Skip, and stops examples from running by removing their
+// output comment.
 type TestSkipper []TestSkip
 
 func (m TestSkipper) Apply(s *Session) Applier {
+	matchers := make([]testMatcher, len(m))
+	expect := map[string]*Expect{}
+	keys := map[string]bool{}
+	for i, ts := range m {
+		if keys[ts.key()] {
+			// matches are counted by key, so only the first skip with a path and name is used
+			matchers[i] = testMatcher{TestSkip: ts, invalid: true}
+			s.report(&Error{Mutator: mutatorName(m), Err: fmt.Errorf("duplicate skip of %s in %s", ts.Name, ts.Path)})
+			continue
+		}
+		keys[ts.key()] = true
+		if ts.Expect != nil {
+			expect[ts.key()] = ts.Expect
+		}
+		var err error
+		if matchers[i], err = newTestMatcher(ts); err != nil {
+			// reported before Run sets the mutator being applied
+			s.report(&Error{Mutator: mutatorName(m), Err: err})
+		}
+	}
 	return Applier{
+		Concurrent: true,
+		Expect:     expect,
 		Apply: func(relpath, fname string) func(*dstutil.Cursor) bool {
 			if !strings.HasSuffix(fname, "_test.go") {
 				return nil
 			}
-			return func(c *dstutil.Cursor) bool {
-				fd, ok := c.Node().(*dst.FuncDecl)
-				if !ok {
-					return true
-				}
-				if !strings.HasPrefix(fd.Name.Name, "Test") {
-					return true
+			var found []testMatcher
+			for _, tm := range matchers {
+				if tm.matchPath(relpath) {
+					found = append(found, tm)
 				}
-				var test TestSkip
-				for _, ts := range m {
-					if ts.Path == relpath && ts.Name == fd.Name.Name {
-						test = ts
-						break
+			}
+			if len(found) == 0 {
+				return nil
+			}
+			find := func(name string) (TestSkip, bool) {
+				for _, tm := range found {
+					if tm.matchName(name) {
+						return tm.TestSkip, true
 					}
 				}
-				if test == (TestSkip{}) {
+				return TestSkip{}, false
+			}
+			skipped := func(test TestSkip) {
+				s.Match(test.key())
+				s.Match("")
+				s.Modified(relpath, fname)
+			}
+			// a matching test is always skipped
+			match := func(name string) (TestSkip, bool) {
+				test, ok := find(name)
+				if ok {
+					skipped(test)
+				}
+				return test, ok
+			}
+			return func(c *dstutil.Cursor) bool {
+				fd, ok := c.Node().(*dst.FuncDecl)
+				if !ok || fd.Recv != nil || fd.Body == nil {
 					return true
 				}
-
-				// check name of testing param (usually t)
-				name := fd.Type.Params.List[0].Names[0].Name
-
-				// create the skip statement
-				skip := &dst.ExprStmt{
-					X: &dst.CallExpr{
-						Fun: &dst.SelectorExpr{
-							X:   dst.NewIdent(name),
-							Sel: dst.NewIdent("Skip"),
-						},
-						Args: []dst.Expr{&dst.BasicLit{Kind: token.STRING, Value: strconv.Quote(test.Comment)}},
-					},
+				name := fd.Name.Name
+				switch {
+				case strings.HasPrefix(name, "Example"):
+					// examples without an output comment don't run, so they're not changed
+					if test, ok := find(name); ok && skipExample(fd, test.Comment) {
+						skipped(test)
+					}
+				case strings.HasPrefix(name, "Test"), strings.HasPrefix(name, "Benchmark"), strings.HasPrefix(name, "Fuzz"):
+					skipTests(fd.Type, fd.Body, name, match)
 				}
-
-				fd.Body.List = append([]dst.Stmt{skip}, fd.Body.List...)
-
 				return true
 			}
 		},
@@ -641,14 +1133,214 @@ func (m TestSkipper) Apply(s *Session) Applier {
 }
 
 type TestSkip struct {
-	Path, Name, Comment string
+	Path, Name, Comment string  // Path is a MatchPath spec. Name is a func name, or a subtest name (e.g. TestFoo/bar).
+	Regexp              bool    // Path and Name are regular expressions that must match the whole relpath and name
+	Expect              *Expect // expected number of funcs skipped
+}
+
+func (ts TestSkip) key() string {
+	return ts.Path + " " + ts.Name
+}
+
+type testMatcher struct {
+	TestSkip
+	path, name *regexp.Regexp
+	invalid    bool
+}
+
+// newTestMatcher compiles the regular expressions of a TestSkip. If they don't compile, the matcher
+// matches nothing.
+func newTestMatcher(ts TestSkip) (testMatcher, error) {
+	tm := testMatcher{TestSkip: ts}
+	if !ts.Regexp {
+		return tm, nil
+	}
+	var err error
+	if tm.path, err = regexp.Compile("^(?:" + ts.Path + ")$"); err != nil {
+		tm.invalid = true
+		return tm, fmt.Errorf("skipping %s: %v", ts.Name, err)
+	}
+	if tm.name, err = regexp.Compile("^(?:" + ts.Name + ")$"); err != nil {
+		tm.invalid = true
+		return tm, fmt.Errorf("skipping %s: %v", ts.Name, err)
+	}
+	return tm, nil
+}
+
+func (tm testMatcher) matchPath(relpath string) bool {
+	if tm.invalid {
+		return false
+	}
+	if tm.Regexp {
+		return tm.path.MatchString(relpath)
+	}
+	return MatchPath(relpath, tm.Path)
+}
+
+func (tm testMatcher) matchName(name string) bool {
+	if tm.Regexp {
+		return tm.name.MatchString(name)
+	}
+	return tm.Name == name
+}
+
+// skipTests adds a skip statement to the body of a test func if it matches, or otherwise to the
+// subtests it runs that match.
+func skipTests(ft *dst.FuncType, body *dst.BlockStmt, name string, match func(string) (TestSkip, bool)) {
+	if len(ft.Params.List) == 0 {
+		return
+	}
+	if test, ok := match(name); ok {
+		param := testParam(ft, body)
+		skip := &dst.ExprStmt{
+			X: &dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X:   dst.NewIdent(param),
+					Sel: dst.NewIdent("Skip"),
+				},
+				Args: []dst.Expr{&dst.BasicLit{Kind: token.STRING, Value: strconv.Quote(test.Comment)}},
+			},
+		}
+		body.List = append([]dst.Stmt{skip}, body.List...)
+		return
+	}
+	field := ft.Params.List[0]
+	if len(field.Names) == 0 || field.Names[0].Name == "_" {
+		// the test can't run subtests
+		return
+	}
+	param := field.Names[0].Name
+	dst.Inspect(body, func(n dst.Node) bool {
+		call, ok := n.(*dst.CallExpr)
+		if !ok || len(call.Args) != 2 {
+			return true
+		}
+		sel, ok := call.Fun.(*dst.SelectorExpr)
+		if !ok || sel.Sel.Name != "Run" {
+			return true
+		}
+		if x, ok := sel.X.(*dst.Ident); !ok || x.Name != param || x.Path != "" {
+			return true
+		}
+		lit, ok := call.Args[0].(*dst.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			return true
+		}
+		fn, ok := call.Args[1].(*dst.FuncLit)
+		if !ok {
+			return true
+		}
+		sub, err := strconv.Unquote(lit.Value)
+		if err != nil {
+			return true
+		}
+		// spaces in subtest names are replaced by underscores by the testing package
+		skipTests(fn.Type, fn.Body, name+"/"+strings.Replace(sub, " ", "_", -1), match)
+		return false
+	})
+}
+
+// testParam returns the name of the first param of a test func, naming it if it's unnamed or blank.
+func testParam(ft *dst.FuncType, body *dst.BlockStmt) string {
+	field := ft.Params.List[0]
+	if len(field.Names) > 0 && field.Names[0].Name != "_" {
+		return field.Names[0].Name
+	}
+	// the param type is *testing.T, *testing.B or *testing.F, so name it t, b or f
+	name := "t"
+	if star, ok := field.Type.(*dst.StarExpr); ok {
+		var sel string
+		switch x := star.X.(type) {
+		case *dst.Ident:
+			sel = x.Name
+		case *dst.SelectorExpr:
+			sel = x.Sel.Name
+		}
+		if sel != "" {
+			name = strings.ToLower(sel[:1])
+		}
+	}
+	// don't shadow an identifier used in the body
+	used := map[string]bool{}
+	dst.Inspect(body, func(n dst.Node) bool {
+		if id, ok := n.(*dst.Ident); ok {
+			used[id.Name] = true
+		}
+		return true
+	})
+	unique := name
+	for i := 1; used[unique]; i++ {
+		unique = fmt.Sprintf("%s%d", name, i)
+	}
+	if len(field.Names) == 0 {
+		field.Names = []*dst.Ident{dst.NewIdent(unique)}
+	} else {
+		field.Names[0] = dst.NewIdent(unique)
+	}
+	return unique
+}
+
+var exampleOutput = regexp.MustCompile(`(?i)^//[[:space:]]*(unordered )?output:`)
+
+// skipExample removes the output comment of an example, so it's compiled but not run. It returns
+// false if the example has no output comment.
+func skipExample(fd *dst.FuncDecl, comment string) bool {
+	if removeOutput(&fd.Body.Decs.Lbrace, comment) {
+		return true
+	}
+	var removed bool
+	dst.Inspect(fd.Body, func(n dst.Node) bool {
+		if n == nil || removed {
+			return false
+		}
+		decs := n.Decorations()
+		removed = removeOutput(&decs.Start, comment) || removeOutput(&decs.End, comment)
+		return !removed
+	})
+	return removed
+}
+
+// removeOutput removes an example output comment (which runs to the end of the comment group) from
+// decorations, replacing it with a comment explaining why if comment is set.
+func removeOutput(decs *dst.Decorations, comment string) bool {
+	for i, line := range *decs {
+		if !exampleOutput.MatchString(line) {
+			continue
+		}
+		end := i + 1
+		for end < len(*decs) && strings.HasPrefix((*decs)[end], "//") {
+			end++
+		}
+		replaced := append([]string{}, (*decs)[:i]...)
+		if comment != "" {
+			replaced = append(replaced, "// skipped: "+comment)
+		}
+		*decs = append(replaced, (*decs)[end:]...)
+		return true
+	}
+	return false
 }
 
 type Manual func(relpath, fname string) func(c *dstutil.Cursor) bool
 
 func (m Manual) Apply(s *Session) Applier {
 	return Applier{
-		Apply: m,
+		Apply:      m,
+		MatchEdits: true,
+	}
+}
+
+// Typed is a mutator with access to the type information of the package being visited. The
+// session is type checked before it's applied if any files have changed since the last type check.
+// Qualified identifiers are *dst.Ident with Path set, and pkg.Info is nil for files that are not
+// type checked: external test packages, _test.go files and files excluded from the host platform by
+// build constraints.
+type Typed func(relpath, fname string, pkg *PackageInfo) func(c *dstutil.Cursor) bool
+
+func (m Typed) Apply(s *Session) Applier {
+	return Applier{
+		ApplyTyped: m,
+		MatchEdits: true,
 	}
 }
 
@@ -659,6 +1351,7 @@ func (m DeleteNodes) Apply(s *Session) Applier {
 		Apply: func(relpath, fname string) func(c *dstutil.Cursor) bool {
 			return func(c *dstutil.Cursor) bool {
 				if m(relpath, fname, c.Node(), c.Parent()) {
+					s.Match("")
 					c.Delete()
 					return false
 				}
@@ -668,10 +1361,23 @@ func (m DeleteNodes) Apply(s *Session) Applier {
 	}
 }
 
+// PathReplacer replaces the package paths that start with any of the Matchers, using Replacement
+// (a regexp replacement string: ${2} is the matched path, and ${1} and ${3} are the characters
+// before and after it).
+//
+// By default paths are replaced in every string literal, which also rewrites unrelated strings
+// that contain a matched path (e.g. error messages). If Imports is set, paths are only replaced
+// in import specs, qualified identifiers, canonical import comments (package x // import "a/b"),
+// //go:linkname targets, //go:generate lines and build constraints, and in the string literals
+// that Literals selects.
 type PathReplacer struct {
 	Matchers    []string
 	Replacement string
+	Extras      func(relpath, fname string) bool // extras to replace paths in (e.g. testdata files) - package paths in assembly symbols are always replaced
+	Imports     bool
+	Literals    func(relpath, fname string, lit *dst.BasicLit, parent dst.Node) bool // string literals to replace paths in if Imports is set
 	matchers    []*regexp.Regexp
+	imports     []*regexp.Regexp // match paths rather than words in strings
 	initialised bool
 }
 
@@ -681,29 +1387,99 @@ func (m *PathReplacer) init() {
 	}
 	for _, s := range m.Matchers {
 		m.matchers = append(m.matchers, regexp.MustCompile(fmt.Sprintf(`(^|\W)(%s)($|\W)`, regexp.QuoteMeta(s))))
+		m.imports = append(m.imports, regexp.MustCompile(fmt.Sprintf(`(^)(%s)($|/)`, regexp.QuoteMeta(s))))
+	}
+	m.initialised = true
+}
+
+func (m *PathReplacer) replace(s string) string {
+	for _, reg := range m.matchers {
+		s = reg.ReplaceAllString(s, m.Replacement)
+	}
+	return s
+}
+
+// replacePath replaces a package path if it starts with a matcher.
+func (m *PathReplacer) replacePath(p string) string {
+	for _, reg := range m.imports {
+		if reg.MatchString(p) {
+			return reg.ReplaceAllString(p, m.Replacement)
+		}
 	}
+	return p
 }
 
 func (m *PathReplacer) Apply(s *Session) Applier {
 	m.init()
+	text := func(relpath, fname string, contents []byte) ([]byte, bool) {
+		if strings.HasSuffix(fname, ".s") {
+			// package paths in assembly symbols
+			if m.Imports {
+				contents = replaceAsmPaths(contents, m.replacePath)
+			} else {
+				contents = replaceAsmPaths(contents, m.replace)
+			}
+		}
+		if m.Extras != nil && m.Extras(relpath, fname) {
+			contents = []byte(m.replace(string(contents)))
+		}
+		return contents, true
+	}
+	replaceLit := func(relpath, fname string, bl *dst.BasicLit, replace func(string) string) {
+		if modified, err := modifyString(bl, replace); err != nil {
+			s.Errorf(relpath, fname, bl, "%v", err)
+		} else if modified {
+			s.Modified(relpath, fname)
+		}
+	}
+	if m.Imports {
+		return Applier{
+			Concurrent: true,
+			ApplyText:  text,
+			Apply: func(relpath, fname string) func(c *dstutil.Cursor) bool {
+				return func(c *dstutil.Cursor) bool {
+					if c.Node() == nil {
+						return true
+					}
+					var modified bool
+					switch n := c.Node().(type) {
+					case *dst.File:
+						modified = m.replaceDirectives(&n.Decs.Package)
+						modified = m.replaceDirectives(&n.Decs.Name) || modified
+					case *dst.ImportSpec:
+						if n.Path != nil {
+							replaceLit(relpath, fname, n.Path, m.replacePath)
+						}
+					case *dst.Ident:
+						if n.Path != "" {
+							p := m.replacePath(n.Path)
+							modified = p != n.Path
+							n.Path = p
+						}
+					case *dst.BasicLit:
+						if _, ok := c.Parent().(*dst.ImportSpec); !ok && n.Kind == token.STRING && m.Literals != nil && m.Literals(relpath, fname, n, c.Parent()) {
+							replaceLit(relpath, fname, n, m.replace)
+						}
+					}
+					decs := c.Node().Decorations()
+					modified = m.replaceDirectives(&decs.Start) || modified
+					modified = m.replaceDirectives(&decs.End) || modified
+					if modified {
+						s.Modified(relpath, fname)
+					}
+					return true
+				}
+			},
+		}
+	}
 	return Applier{
+		Concurrent: true,
+		ApplyText:  text,
 		Apply: func(relpath, fname string) func(c *dstutil.Cursor) bool {
 			return func(c *dstutil.Cursor) bool {
 				if bl, ok := c.Node().(*dst.BasicLit); ok && bl.Kind == token.STRING {
-					s, err := strconv.Unquote(bl.Value)
-					if err != nil {
-						panic(err)
-					}
-					for _, reg := range m.matchers {
-						s = reg.ReplaceAllString(s, m.Replacement)
-					}
-					if strconv.Quote(s) == bl.Value {
-						return false
-					}
-					c.Replace(&dst.BasicLit{
-						Kind:  token.STRING,
-						Value: strconv.Quote(s),
-					})
+					replaceLit(relpath, fname, bl, m.replace)
+					return false
 				}
 				return true
 			}
@@ -711,6 +1487,50 @@ func (m *PathReplacer) Apply(s *Session) Applier {
 	}
 }
 
+var importComment = regexp.MustCompile(`^(//\s*import\s+|/\*\s*import\s+)"([^"]*)"`)
+
+// replaceDirectives replaces paths in the import comments, directives and build constraints in
+// decorations, and returns true if any changed.
+func (m *PathReplacer) replaceDirectives(decs *dst.Decorations) bool {
+	var modified bool
+	for i, d := range *decs {
+		switch {
+		case importComment.MatchString(d):
+			match := importComment.FindStringSubmatchIndex(d)
+			p := d[match[4]:match[5]]
+			(*decs)[i] = d[:match[4]] + m.replacePath(p) + d[match[5]:]
+		case strings.HasPrefix(d, "//go:linkname "):
+			pkgpath, name, ok := linknameTarget(d)
+			if !ok {
+				continue
+			}
+			fields := strings.Fields(d)
+			(*decs)[i] = strings.Join([]string{fields[0], fields[1], m.replacePath(pkgpath) + "." + name}, " ")
+		case strings.HasPrefix(d, "//go:generate "), strings.HasPrefix(d, "//go:build "), strings.HasPrefix(d, "// +build "):
+			(*decs)[i] = m.replace(d)
+		}
+		modified = modified || (*decs)[i] != d
+	}
+	return modified
+}
+
+// linknameTarget returns the package path and name of the target of a //go:linkname directive
+// (//go:linkname localname importpath.name). The name of a method includes its receiver type.
+func linknameTarget(directive string) (pkgpath, name string, ok bool) {
+	fields := strings.Fields(directive)
+	if len(fields) != 3 || fields[0] != "//go:linkname" {
+		return "", "", false
+	}
+	target := fields[2]
+	slash := strings.LastIndex(target, "/") + 1
+	dot := strings.Index(target[slash:], ".")
+	if dot < 0 {
+		return "", "", false
+	}
+	dot += slash
+	return target[:dot], target[dot+1:], true
+}
+
 type ModifyStrings func(s string) string
 
 func (m ModifyStrings) Apply(s *Session) Applier {
@@ -718,15 +1538,12 @@ func (m ModifyStrings) Apply(s *Session) Applier {
 		Apply: func(relpath, fname string) func(c *dstutil.Cursor) bool {
 			return func(c *dstutil.Cursor) bool {
 				if bl, ok := c.Node().(*dst.BasicLit); ok && bl.Kind == token.STRING {
-					s, err := strconv.Unquote(bl.Value)
-					if err != nil {
-						panic(err)
+					if modified, err := modifyString(bl, m); err != nil {
+						s.Errorf(relpath, fname, bl, "%v", err)
+					} else if modified {
+						s.Modified(relpath, fname)
 					}
-					s = m(s)
-					c.Replace(&dst.BasicLit{
-						Kind:  token.STRING,
-						Value: strconv.Quote(s),
-					})
+					return false
 				}
 				return true
 			}
@@ -734,6 +1551,32 @@ func (m ModifyStrings) Apply(s *Session) Applier {
 	}
 }
 
+// modifyString updates a string literal in place, so its decorations are kept, and returns true if
+// it changed. The literal isn't touched if the string doesn't change, and raw strings stay raw if
+// possible.
+func modifyString(bl *dst.BasicLit, modify func(string) string) (bool, error) {
+	str, err := strconv.Unquote(bl.Value)
+	if err != nil {
+		return false, err
+	}
+	modified := modify(str)
+	if modified == str {
+		return false, nil
+	}
+	if strings.HasPrefix(bl.Value, "`") && canRawQuote(modified) {
+		bl.Value = "`" + modified + "`"
+	} else {
+		bl.Value = strconv.Quote(modified)
+	}
+	return true, nil
+}
+
+// canRawQuote returns true if a string can be written as a raw string literal (carriage returns
+// are discarded from raw strings, so they can't be represented).
+func canRawQuote(s string) bool {
+	return utf8.ValidString(s) && !strings.ContainsAny(s, "`\r\x00\uFEFF")
+}
+
 type FilterFiles func(relpath, fname string) bool
 
 func (m FilterFiles) Apply(s *Session) Applier {
@@ -745,24 +1588,78 @@ func (m FilterFiles) Apply(s *Session) Applier {
 type Applier struct {
 	FileFilter func(relpath, fname string) bool
 	Apply      func(relpath, fname string) func(*dstutil.Cursor) bool
+	ApplyTyped func(relpath, fname string, pkg *PackageInfo) func(*dstutil.Cursor) bool // like Apply, with type information for the host platform (Apply is ignored if set)
+	ApplyText  func(relpath, fname string, contents []byte) (result []byte, keep bool)  // rewrites the contents of extras, or deletes the file if keep is false
 	Func       func()
+	Expect     map[string]*Expect // expected number of matches for each key, counted with Session.Match
+	MatchEdits bool               // count the nodes replaced, deleted or inserted by the cursor functions as matches of ""
+	Concurrent bool               // Apply and ApplyText are safe to call concurrently for different files
+}
+
+// Concurrent marks a mutator as safe to apply concurrently to different files.
+func Concurrent(m Mutator) Mutator {
+	return concurrent{m}
+}
+
+type concurrent struct {
+	Mutator
+}
+
+func (m concurrent) Apply(s *Session) Applier {
+	a := m.Mutator.Apply(s)
+	a.Concurrent = true
+	return a
 }
 
 func dirToPath(dir string) string {
 	return strings.Trim(filepath.ToSlash(dir), "/")
 }
 
+// MatchPath reports whether dir matches the specs. Specs are slash separated globs: "*" matches
+// any sequence of characters in a path element, "?" matches one character, "[a-z]" matches a
+// character class (as in path.Match), and "**" matches any number of path elements - except at
+// the end, where "a/**" matches everything under a, but not a itself. Specs are evaluated in order,
+// and a spec starting with "!" excludes the dirs it matches, so "a/**", "!a/b" matches everything
+// under a except a/b. Malformed specs don't match anything.
 func MatchPath(dir string, specs ...string) bool {
+	var matched bool
 	for _, spec := range specs {
-		if strings.HasSuffix(spec, "/**") {
-			if strings.HasPrefix(dir, strings.TrimSuffix(spec, "**")) {
-				return true
+		negate := strings.HasPrefix(spec, "!")
+		if negate {
+			spec = spec[1:]
+		}
+		if matched == !negate {
+			// the spec can't change the result
+			continue
+		}
+		if matchGlob(strings.Split(spec, "/"), strings.Split(dir, "/")) {
+			matched = !negate
+		}
+	}
+	return matched
+}
+
+func matchGlob(spec, dir []string) bool {
+	for len(spec) > 0 {
+		if spec[0] == "**" {
+			if len(spec) == 1 {
+				// trailing ** matches one or more elements
+				return len(dir) > 0
 			}
-		} else {
-			if dir == spec {
-				return true
+			for i := 0; i <= len(dir); i++ {
+				if matchGlob(spec[1:], dir[i:]) {
+					return true
+				}
 			}
+			return false
+		}
+		if len(dir) == 0 {
+			return false
 		}
+		if ok, err := path.Match(spec[0], dir[0]); err != nil || !ok {
+			return false
+		}
+		spec, dir = spec[1:], dir[1:]
 	}
-	return false
+	return len(dir) == 0
 }
@@ -4,15 +4,17 @@ import (
 	"bytes"
 	"fmt"
 	"go/format"
+	"go/token"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 	"testing"
 
+	"github.com/dave/dst"
+	"github.com/dave/dst/dstutil"
 	"github.com/dave/services/fsutil"
 	"gopkg.in/src-d/go-billy.v4"
-	"gopkg.in/src-d/go-billy.v4/memfs"
 	"gopkg.in/src-d/go-billy.v4/util"
 )
 
@@ -39,7 +41,7 @@ func TestAll(t *testing.T) {
 				func pointer_assign(v *int) {
 					*v = 1
 				}`,
-			mutators: Libify{[]string{"a"}},
+			mutators: Libify{Packages: []string{"a"}},
 			expected: map[string]string{
 				"a.go": `package main
 		
@@ -79,7 +81,7 @@ func TestAll(t *testing.T) {
 		},
 		"libify simple": {
 			files:    `func main(){}; func Foo() {}`,
-			mutators: Libify{[]string{"main"}},
+			mutators: Libify{Packages: []string{"main"}},
 			expected: map[string]string{
 				"main.go": `func main(){}; func Foo() {}`,
 				"package-state.go": `
@@ -93,7 +95,7 @@ func TestAll(t *testing.T) {
 		},
 		"libify other methods": {
 			files:    `func main(){}; type F string; func (F) Foo() { a++ }; var a int`,
-			mutators: Libify{[]string{"main"}},
+			mutators: Libify{Packages: []string{"main"}},
 			expected: map[string]string{
 				"main.go": `func main(){}; type F string; func (F) Foo(pstate *PackageState) {
 					pstate.a++
@@ -110,7 +112,7 @@ func TestAll(t *testing.T) {
 		},
 		"libify var unused": {
 			files:    `func main(){}; var i int`,
-			mutators: Libify{[]string{"main"}},
+			mutators: Libify{Packages: []string{"main"}},
 			expected: map[string]string{
 				"main.go": `func main(){}; var i int`,
 				"package-state.go": `
@@ -124,7 +126,7 @@ func TestAll(t *testing.T) {
 		},
 		"libify var used": {
 			files:    `func main(){}; func a(){ i = 1 }; var i int`,
-			mutators: Libify{[]string{"main"}},
+			mutators: Libify{Packages: []string{"main"}},
 			expected: map[string]string{
 				"main.go": `func main(){}; func (pstate *PackageState) a() {
 					pstate.i = 1
@@ -141,7 +143,7 @@ func TestAll(t *testing.T) {
 		},
 		"libify var init": {
 			files:    `func main(){}; var i, j = 1, 2; func a(){ i = 2; print(j) }`,
-			mutators: Libify{[]string{"main"}},
+			mutators: Libify{Packages: []string{"main"}},
 			expected: map[string]string{
 				"main.go": `func main(){}; var j = 2; func (pstate *PackageState) a() {
 					pstate.i = 2
@@ -160,7 +162,7 @@ func TestAll(t *testing.T) {
 		},
 		"libify func unused": {
 			files:    `func main(){}; func a() int{return 1}; func c() int {return b}; var b = a()`,
-			mutators: Libify{[]string{"main"}},
+			mutators: Libify{Packages: []string{"main"}},
 			expected: map[string]string{
 				"main.go": `
 					func main(){}
@@ -185,7 +187,7 @@ func TestAll(t *testing.T) {
 				var a, b = f1(), 1
 				func f3(){ a++ }
 				func f4() int { return b }`,
-			mutators: Libify{[]string{"main"}},
+			mutators: Libify{Packages: []string{"main"}},
 			expected: map[string]string{
 				"main.go": `
 					func main(){}
@@ -226,7 +228,7 @@ func TestAll(t *testing.T) {
 					v3--
 				}
 				`,
-			mutators: Libify{[]string{"main"}},
+			mutators: Libify{Packages: []string{"main"}},
 			expected: map[string]string{
 				"main.go": `
 					func main(){}
@@ -262,7 +264,7 @@ func TestAll(t *testing.T) {
 		},
 		"libify var init order": {
 			files:    `func main(){}; var a = b; var b = 1; func f1() {a, b = 1, 2}`,
-			mutators: Libify{[]string{"main"}},
+			mutators: Libify{Packages: []string{"main"}},
 			expected: map[string]string{
 				"main.go": `
 					func main(){}
@@ -290,7 +292,7 @@ func TestAll(t *testing.T) {
 			// TODO: FIX THIS
 			skip:     true,
 			files:    `func main(){}; var a = b; var b = 1; func f1() { b = 2 }`,
-			mutators: Libify{[]string{"main"}},
+			mutators: Libify{Packages: []string{"main"}},
 			expected: map[string]string{
 				"main.go": `
 					func main(){}
@@ -317,7 +319,7 @@ func TestAll(t *testing.T) {
 				"main": {"main.go": `package main; import "b"; func main(){}; var a = b.B(); func f(){ a = "c" }`},
 				"b":    {"b.go": `package b; func B() string { return "b" }`},
 			},
-			mutators: Libify{[]string{"main"}},
+			mutators: Libify{Packages: []string{"main"}},
 			expected: map[string]map[string]string{
 				"main": {
 					"main.go": `
@@ -362,7 +364,7 @@ func TestAll(t *testing.T) {
 				"main": {"main.go": `package main; import "b"; func main(){}; func a(){b.B()}`},
 				"b":    {"b.go": `package b; func B(){a++}; var a = 1`},
 			},
-			mutators: Libify{[]string{"main"}},
+			mutators: Libify{Packages: []string{"main"}},
 			expected: map[string]map[string]string{
 				"main": {
 					"main.go": `
@@ -405,7 +407,7 @@ func TestAll(t *testing.T) {
 		"libify type": {
 			single:   true,
 			files:    `func main(){}; type T struct {i int}`,
-			mutators: Libify{[]string{"main"}},
+			mutators: Libify{Packages: []string{"main"}},
 			expected: map[string]string{
 				"main.go": `func main(){}; type T struct {pstate *PackageState; i int}`,
 				"package-state.go": `
@@ -468,10 +470,11 @@ type testspec struct {
 }
 
 func runTest(spec testspec) error {
-	s := NewSession("", "")
-	s.out = &bytes.Buffer{}
+	s := NewSession("/", "", "")
+	s.Observer = NewTextObserver(&bytes.Buffer{})
 	s.gopathsrc = "/"
-	s.fs = memfs.New()
+	s.fs = newMemFS()
+	s.outdir = "/out"
 
 	files := normalize("main", spec.files)
 	expected := normalize("main", spec.expected)
@@ -505,12 +508,16 @@ func runTest(spec testspec) error {
 
 	// then walk the actual output filesystem, and compare every file
 	var actual int
-	if err := fsutil.Walk(s.fs, "/", func(fs billy.Filesystem, fpath string, finfo os.FileInfo, err error) error {
+	if err := fsutil.Walk(s.fs, "/out", func(fs billy.Filesystem, fpath string, finfo os.FileInfo, err error) error {
 		if finfo == nil {
 			return nil
 		}
-		if !finfo.IsDir() {
-			dir, fname := filepath.Split(fpath)
+		rel, err := filepath.Rel("/out", fpath)
+		if err != nil {
+			return err
+		}
+		if !finfo.IsDir() && rel != ManifestName {
+			dir, fname := filepath.Split(rel)
 			path := dirToPath(dir)
 			if expected[path] == nil {
 				return fmt.Errorf("path %s not expected", path)
@@ -549,6 +556,23 @@ func runTest(spec testspec) error {
 	return nil
 }
 
+// newTestSession returns a session for the source files (path -> contents) in an in memory
+// filesystem rooted at /, that saves its output to /out.
+func newTestSession(t *testing.T, files map[string]string) *Session {
+	t.Helper()
+	s := NewSession("/", "", "")
+	s.Observer = NewTextObserver(&bytes.Buffer{})
+	s.gopathsrc = "/"
+	s.fs = newMemFS()
+	s.outdir = "/out"
+	for fpath, contents := range files {
+		if err := util.WriteFile(s.fs, filepath.Join("/", fpath), []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
 func normalize(name string, i interface{}) map[string]map[string]string {
 	var m map[string]map[string]string
 	switch v := i.(type) {
@@ -568,3 +592,424 @@ func normalize(name string, i interface{}) map[string]map[string]string {
 	}
 	return m
 }
+
+func TestLibifyPlatforms(t *testing.T) {
+	files := map[string]string{
+		"main/main.go":         `package main; func main(){ arch(); plat() }; var i int`,
+		"main/arch_linux.go":   `package main; func arch(){ i = 1 }; var l int`,
+		"main/arch_windows.go": `package main; func arch(){ w++ }; var w int`,
+		// only the windows variant of plat uses vars
+		"main/plat_linux.go":   `package main; func plat(){ println() }`,
+		"main/plat_windows.go": `package main; func plat(){ w = 2 }`,
+	}
+	s := newTestSession(t, files)
+	mutator := Libify{
+		Packages:  []string{"main"},
+		Platforms: []Platform{{"linux", "amd64"}, {"windows", "amd64"}},
+	}
+	if err := s.Run([]Mutator{mutator}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{
+		"main/arch_linux.go":    {"func (pstate *PackageState) arch()", "pstate.i = 1"},
+		"main/arch_windows.go":  {"func (pstate *PackageState) arch()", "pstate.w++"},
+		"main/main.go":          {"pstate.arch()", "pstate.plat()"},
+		"main/plat_linux.go":    {"func (pstate *PackageState) plat()"},
+		"main/plat_windows.go":  {"func (pstate *PackageState) plat()", "pstate.w = 2"},
+		"main/package-state.go": {"i int", "l int", "w int"},
+	}
+	for fpath, contains := range expected {
+		found, err := readFile(s.fs, filepath.Join("/out", fpath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range contains {
+			if !strings.Contains(string(found), c) {
+				t.Fatalf("%s should contain %q:\n%s", fpath, c, string(found))
+			}
+		}
+	}
+}
+
+func TestTyped(t *testing.T) {
+	files := map[string]string{
+		"a/a.go":       `package a; const X = 1`,
+		"main/main.go": `package main; import "a"; const X = 2; func main(){ println(a.X, X) }`,
+		// tests aren't type checked
+		"main/main_test.go": `package main; import "a"; func f(){ println(a.X) }`,
+	}
+	s := newTestSession(t, files)
+	obs := &typecheckCounter{TextObserver: NewTextObserver(&bytes.Buffer{})}
+	s.Observer = obs
+
+	// replaces uses of a.X with a literal
+	var untyped []string
+	replace := Typed(func(relpath, fname string, pkg *PackageInfo) func(c *dstutil.Cursor) bool {
+		if pkg.Info == nil {
+			untyped = append(untyped, fname)
+			return nil
+		}
+		return func(c *dstutil.Cursor) bool {
+			id, ok := c.Node().(*dst.Ident)
+			if !ok {
+				return true
+			}
+			obj := pkg.Info.Uses[pkg.NodesAst.Ident(id)]
+			if obj != nil && obj.Pkg() != nil && obj.Pkg().Path() == "a" && obj.Name() == "X" {
+				c.Replace(&dst.BasicLit{Kind: token.INT, Value: "1"})
+			}
+			return true
+		}
+	})
+	nothing := Typed(func(relpath, fname string, pkg *PackageInfo) func(c *dstutil.Cursor) bool {
+		return nil
+	})
+	identity := ModifyStrings(func(s string) string { return s })
+	if err := s.Run([]Mutator{identity, replace, nothing, identity, nothing}); err != nil {
+		t.Fatal(err)
+	}
+	// type checked before the first typed mutator, and after replace changed main.go
+	if obs.count != 2 {
+		t.Fatalf("expected 2 type checks, got %d", obs.count)
+	}
+	if len(untyped) != 1 || untyped[0] != "main_test.go" {
+		t.Fatalf("expected no type information for main_test.go only, got %v", untyped)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	found, err := readFile(s.fs, "/out/main/main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(found), "println(1, X)") {
+		t.Fatalf("unexpected main.go:\n%s", string(found))
+	}
+}
+
+type typecheckCounter struct {
+	*TextObserver
+	count int
+}
+
+func (o *typecheckCounter) PhaseStart(phase string, total int) {
+	if strings.HasPrefix(phase, "Type checking") {
+		o.count++
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		dir   string
+		specs []string
+		match bool
+	}{
+		{"a", []string{"a"}, true},
+		{"a/b", []string{"a"}, false},
+		{"a", []string{"a/**"}, false},
+		{"a/b", []string{"a/**"}, true},
+		{"a/b/c", []string{"a/**"}, true},
+		{"ab/c", []string{"a/**"}, false},
+		{"a/b/testdata", []string{"**/testdata"}, true},
+		{"testdata", []string{"**/testdata"}, true},
+		{"a/testdata/b", []string{"**/testdata"}, false},
+		{"a/testdata/b", []string{"**/testdata/**"}, true},
+		{"src/cmd/link/internal", []string{"src/cmd/*/internal"}, true},
+		{"src/cmd/link/ld/internal", []string{"src/cmd/*/internal"}, false},
+		{"a/x/y/b", []string{"a/**/b"}, true},
+		{"a/b", []string{"a/**/b"}, true},
+		{"a/b1", []string{"a/b?"}, true},
+		{"a/b12", []string{"a/b?"}, false},
+		{"a/b1", []string{"a/b[0-9]"}, true},
+		{"a/bx", []string{"a/b[0-9]"}, false},
+		{"obj/x86", []string{"obj/**", "!obj/wasm"}, true},
+		{"obj/wasm", []string{"obj/**", "!obj/wasm"}, false},
+		{"obj/wasm", []string{"obj/**", "!obj/wasm", "obj/w*"}, true},
+		{"a", []string{"!a"}, false},
+		{"a", []string{"a["}, false},
+		{"a", []string{"b", "a"}, true},
+	}
+	for _, test := range tests {
+		if found := MatchPath(test.dir, test.specs...); found != test.match {
+			t.Errorf("MatchPath(%q, %q): expected %v, got %v", test.dir, test.specs, test.match, found)
+		}
+	}
+}
+
+func TestTestSkipper(t *testing.T) {
+	tests := map[string]testspec{
+		"tests, benchmarks and fuzz tests": {
+			files: map[string]string{
+				"a_test.go": `
+					func TestA(t *T) {}
+					func TestB(t *T) {}
+					func BenchmarkA(b *B) {}
+					func FuzzA(f *F) {}`,
+			},
+			mutators: TestSkipper{
+				{Path: "main", Name: "TestA", Comment: "a"},
+				{Path: "main", Name: "BenchmarkA", Comment: "b"},
+				{Path: "main", Name: "FuzzA", Comment: "c"},
+				{Path: "other", Name: "TestB", Comment: "d"},
+			},
+			expected: map[string]string{
+				"a_test.go": `
+					func TestA(t *T) { t.Skip("a") }
+					func TestB(t *T) {}
+					func BenchmarkA(b *B) { b.Skip("b") }
+					func FuzzA(f *F) { f.Skip("c") }`,
+			},
+		},
+		"unnamed params": {
+			files: map[string]string{
+				"a_test.go": `
+					var b int
+					func TestA(*T) {}
+					func BenchmarkA(_ *B) { b++ }`,
+			},
+			mutators: TestSkipper{
+				{Path: "main", Name: "TestA", Comment: "a"},
+				{Path: "main", Name: "BenchmarkA", Comment: "b"},
+			},
+			expected: map[string]string{
+				"a_test.go": `
+					var b int
+					func TestA(t *T) { t.Skip("a") }
+					func BenchmarkA(b1 *B) { b1.Skip("b"); b++ }`,
+			},
+		},
+		"subtests": {
+			files: map[string]string{
+				"a_test.go": `
+					func TestA(t *T) {
+						t.Run("foo bar", func(t *T) {
+							t.Run("baz", func(tt *T) {})
+							t.Run("qux", func(tt *T) {})
+						})
+						t.Run("foo", func(t *T) {})
+					}`,
+			},
+			mutators: TestSkipper{
+				{Path: "main", Name: "TestA/foo_bar/baz", Comment: "a"},
+				{Path: "main", Name: "TestA/foo", Comment: "b"},
+			},
+			expected: map[string]string{
+				"a_test.go": `
+					func TestA(t *T) {
+						t.Run("foo bar", func(t *T) {
+							t.Run("baz", func(tt *T) { tt.Skip("a") })
+							t.Run("qux", func(tt *T) {})
+						})
+						t.Run("foo", func(t *T) { t.Skip("b") })
+					}`,
+			},
+		},
+		"regexp": {
+			files: map[string]string{
+				"a_test.go": `
+					func TestA1(t *T) {}
+					func TestA2(t *T) {}
+					func TestAB(t *T) {}
+					func TestB(t *T) {
+						t.Run("c", func(t *T) {})
+					}`,
+			},
+			mutators: TestSkipper{
+				{Path: "ma.*", Name: "TestA[0-9]|TestB/.", Comment: "a", Regexp: true},
+				{Path: "a.*", Name: "TestAB", Comment: "b", Regexp: true},
+			},
+			expected: map[string]string{
+				"a_test.go": `
+					func TestA1(t *T) { t.Skip("a") }
+					func TestA2(t *T) { t.Skip("a") }
+					func TestAB(t *T) {}
+					func TestB(t *T) {
+						t.Run("c", func(t *T) { t.Skip("a") })
+					}`,
+			},
+		},
+		"examples": {
+			files: map[string]string{
+				"a_test.go": `
+					func ExampleA() {
+						println("a")
+						// Output:
+						// a
+					}
+					func ExampleB() {
+						println("b")
+						// Unordered output: b
+					}`,
+			},
+			mutators: TestSkipper{
+				{Path: "main", Name: "ExampleA", Comment: "a"},
+				{Path: "main", Name: "ExampleB"},
+			},
+			expected: map[string]string{
+				"a_test.go": `
+					func ExampleA() {
+						println("a")
+						// skipped: a
+					}
+					func ExampleB() {
+						println("b")
+					}`,
+			},
+		},
+	}
+	for name, spec := range tests {
+		if err := runTest(spec); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	s := newTestSession(t, map[string]string{"a/a_test.go": "package a\n\nfunc TestA(t *T) {}\n"})
+	err := s.Run([]Mutator{TestSkipper{{Path: "a", Name: "Test(", Regexp: true}}})
+	if err == nil || !strings.HasPrefix(err.Error(), "forky.TestSkipper: skipping Test(: ") {
+		t.Fatalf("expected invalid regexp error, got %v", err)
+	}
+
+	// examples without an output comment aren't changed, so they aren't counted
+	s = newTestSession(t, map[string]string{"a/a_test.go": "package a\n\nfunc ExampleA() {}\n"})
+	err = s.Run([]Mutator{TestSkipper{{Path: "a", Name: "ExampleA", Expect: Exactly(1)}}})
+	if err == nil || !strings.Contains(err.Error(), "a ExampleA: expected exactly 1 match, found 0") {
+		t.Fatalf("expected unmet expectation, got %v", err)
+	}
+
+	s = newTestSession(t, map[string]string{"a/a_test.go": "package a\n\nfunc TestA(t *T) {}\n"})
+	err = s.Run([]Mutator{TestSkipper{{Path: "a", Name: "TestA"}, {Path: "a", Name: "TestA", Expect: Exactly(0)}}})
+	if err == nil || err.Error() != "forky.TestSkipper: duplicate skip of TestA in a" {
+		t.Fatalf("expected duplicate error, got %v", err)
+	}
+}
+
+func TestPathReplacerImports(t *testing.T) {
+	files := map[string]string{
+		"a/a.go": "//go:generate go run cmd/link/gen.go\n\n" +
+			"package a // import \"cmd/link/a\"\n\n" +
+			"import (\n\t\"cmd/link\"\n\t\"cmd/linker\"\n\t_ \"unsafe\"\n\t\"x/cmd/link\"\n)\n\n" +
+			"//go:linkname f cmd/link/internal/ld.f\n" +
+			"func f()\n\n" +
+			"var e = \"cmd/link failed\"\n",
+		"a/a_test.go": "package a\n\nvar e = \"cmd/link failed\"\n",
+		"a/a_amd64.s": "TEXT cmd∕link∕internal∕ld·f(SB),0,$0\nTEXT x∕cmd∕link·f(SB),0,$0\n",
+	}
+	s := newTestSession(t, files)
+	err := s.Run([]Mutator{
+		&PathReplacer{
+			Matchers:    []string{"cmd/link"},
+			Replacement: "${1}a.com/${2}${3}",
+			Imports:     true,
+			Literals: func(relpath, fname string, lit *dst.BasicLit, parent dst.Node) bool {
+				return strings.HasSuffix(fname, "_test.go")
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"a.go": "//go:generate go run a.com/cmd/link/gen.go\n\n" +
+			"package a // import \"a.com/cmd/link/a\"\n\n" +
+			"import (\n\t\"a.com/cmd/link\"\n\t\"cmd/linker\"\n\t_ \"unsafe\"\n\t\"x/cmd/link\"\n)\n\n" +
+			"//go:linkname f a.com/cmd/link/internal/ld.f\n" +
+			"func f()\n\n" +
+			"var e = \"cmd/link failed\"\n",
+		"a_test.go": "package a\n\nvar e = \"a.com/cmd/link failed\"\n",
+	}
+	for fname, contents := range expected {
+		found := string(s.printFile("a", s.paths["a"].Packages["a"].Files[fname]))
+		if found != contents {
+			t.Fatalf("unexpected contents in %s:\n%s", fname, found)
+		}
+	}
+	asm := "TEXT a·com∕cmd∕link∕internal∕ld·f(SB),0,$0\nTEXT x∕cmd∕link·f(SB),0,$0\n"
+	if found := string(s.paths["a"].Contents["a_amd64.s"]); found != asm {
+		t.Fatalf("unexpected contents in a_amd64.s:\n%s", found)
+	}
+}
+
+func TestModifyStringsQuoting(t *testing.T) {
+	replaceFoo := ModifyStrings(func(s string) string {
+		if strings.HasPrefix(s, "foo") {
+			return strings.Replace(s, "foo", "bar", -1)
+		}
+		return s
+	})
+	tests := map[string]testspec{
+		"raw strings": {
+			files:    "var a = `foo\n\"x\"\n`\nvar b = `foo`",
+			mutators: replaceFoo,
+			expected: "var a = `bar\n\"x\"\n`\nvar b = `bar`",
+		},
+		"raw string that can't stay raw": {
+			files: "var a = `foo`",
+			mutators: ModifyStrings(func(s string) string {
+				return strings.Replace(s, "foo", "`", -1)
+			}),
+			expected: "var a = \"`\"",
+		},
+		"unchanged strings": {
+			files:    "var a = \"\\x41\"\nvar b = \"foo\\x41\"",
+			mutators: replaceFoo,
+			expected: "var a = \"\\x41\"\nvar b = \"barA\"",
+		},
+		"decorations": {
+			files: "var a = /* x */ \"foo\" // y\nvar b = []string{\n\t\"foo\", // z\n}",
+			mutators: []Mutator{
+				replaceFoo,
+				&PathReplacer{Matchers: []string{"bar"}, Replacement: "${1}a.com/${2}${3}"},
+			},
+			expected: "var a = /* x */ \"a.com/bar\" // y\nvar b = []string{\n\t\"a.com/bar\", // z\n}",
+		},
+	}
+	for name, spec := range tests {
+		if err := runTest(spec); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestResolvePackageNames(t *testing.T) {
+	files := map[string]string{
+		"x/y/y.go":            "package z\n\nfunc F() {}\n",
+		"main/vendor/v/v.go":  "package w\n\nfunc G() {}\n",
+		"main/main.go":        "package main\n\nimport (\n\t\"v\"\n\t\"x/y\"\n)\n\nfunc main() {\n\tz.F()\n\tw.G()\n}\n",
+		"other/other.go":      "package other\n\nimport z \"x/y\"\n\nfunc H() { z.F() }\n",
+		"other/other_test.go": "package other_test\n",
+	}
+	s := newTestSession(t, files)
+	// type checks, so the files are printed with import management
+	nothing := Typed(func(relpath, fname string, pkg *PackageInfo) func(c *dstutil.Cursor) bool {
+		return nil
+	})
+	if err := s.Run([]Mutator{nothing}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	for fpath, contents := range map[string]string{
+		"main/main.go":   files["main/main.go"],
+		"other/other.go": files["other/other.go"],
+	} {
+		found, err := readFile(s.fs, "/out/"+fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(found) != contents {
+			t.Fatalf("unexpected contents in %s:\n%s", fpath, string(found))
+		}
+	}
+	r := packageResolver{s: s, relpath: "main"}
+	for importPath, expected := range map[string]string{"x/y": "z", "v": "w", "fmt": "fmt", "a/b/c": "c"} {
+		if name, err := r.ResolvePackage(importPath); err != nil || name != expected {
+			t.Fatalf("expected %s to resolve to %s, found %s (%v)", importPath, expected, name, err)
+		}
+	}
+}
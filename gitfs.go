@@ -0,0 +1,433 @@
+package forky
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// ReadGit sets the session to read the source from the tree of a revision (tag, branch or commit
+// hash) in the local git repository at repo, instead of from the source dir. The source dir must be
+// in the repository, and is read from the same dir of the tree (the root of the tree if the source
+// dir is empty). The working copy is not used. The output is still written to the filesystem.
+func (s *Session) ReadGit(repo, revision string) error {
+	rel := "."
+	if s.dir != "" {
+		absRepo, err := filepath.Abs(repo)
+		if err != nil {
+			return err
+		}
+		absDir, err := filepath.Abs(s.dir)
+		if err != nil {
+			return err
+		}
+		if rel, err = filepath.Rel(absRepo, absDir); err != nil {
+			return err
+		}
+		if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("source dir %s is not in the repository %s", s.dir, repo)
+		}
+	}
+	commit, err := gitCommit(repo, revision)
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	if rel != "." {
+		if _, err := tree.Tree(filepath.ToSlash(rel)); err != nil {
+			return fmt.Errorf("%s not found at %s: %v", filepath.ToSlash(rel), revision, err)
+		}
+	}
+	s.srcfs = &treeFS{tree: tree}
+	s.dir = filepath.Join("/", rel)
+	s.revision = revision
+	if revision != commit.Hash.String() {
+		s.revision += " (" + commit.Hash.String() + ")"
+	}
+	return nil
+}
+
+func gitCommit(repo, revision string) (*object.Commit, error) {
+	r, err := git.PlainOpen(repo)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := r.ResolveRevision(plumbing.Revision(revision))
+	if err != nil {
+		return nil, err
+	}
+	return r.CommitObject(*hash)
+}
+
+// SaveGit writes the output as a new commit on a branch of the local git repository at repo,
+// instead of to the destination dir. The root of the output is the root of the commit tree, and
+// the commit message names the source revision and the mutators that have been applied. If the
+// branch exists, the commit is added on top of it, otherwise the branch is created. The working
+// copy and index of the repository are not changed, so SaveGit fails if the branch is checked out
+// (the working copy would show the reverse of the commit as changes), unless Force is set.
+func (s *Session) SaveGit(repo, branch string, author object.Signature) (plumbing.Hash, error) {
+	tempfs, err := s.render("Saving", repo)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	r, err := git.PlainOpen(repo)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	tree, err := writeTree(r, tempfs, "/")
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	name := plumbing.NewBranchReferenceName(branch)
+	if !s.Force {
+		head, err := r.Reference(plumbing.HEAD, false)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		if _, err := r.Worktree(); err != git.ErrIsBareRepository && head.Target() == name {
+			return plumbing.ZeroHash, fmt.Errorf("branch %s is checked out in %s (set Force to commit to it anyway)", branch, repo)
+		}
+	}
+	var parents []plumbing.Hash
+	ref, err := r.Reference(name, true)
+	switch {
+	case err == plumbing.ErrReferenceNotFound:
+	case err != nil:
+		return plumbing.ZeroHash, err
+	default:
+		parents = append(parents, ref.Hash())
+	}
+
+	if author.When.IsZero() {
+		author.When = time.Now()
+	}
+	commit := &object.Commit{
+		Author:       author,
+		Committer:    author,
+		Message:      s.commitMessage(),
+		TreeHash:     tree,
+		ParentHashes: parents,
+	}
+	hash, err := writeObject(r, commit)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if err := r.Storer.SetReference(plumbing.NewHashReference(name, hash)); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return hash, nil
+}
+
+// commitMessage describes the source and the mutators applied, e.g.:
+//
+//	forky: go.googlesource.com/go at go1.12 (0c0c2d3...)
+//
+//	Mutators:
+//		forky.FilterFiles
+//		forky.PathReplacer
+func (s *Session) commitMessage() string {
+	source := s.source
+	if source == "" {
+		source = s.dir
+	}
+	msg := "forky: " + source
+	if s.revision != "" {
+		msg += " at " + s.revision
+	}
+	msg += "\n"
+	if len(s.applied) > 0 {
+		msg += "\nMutators:\n"
+		for _, name := range s.applied {
+			msg += "\t" + name + "\n"
+		}
+	}
+	return msg
+}
+
+type encoder interface {
+	Encode(plumbing.EncodedObject) error
+}
+
+func writeObject(r *git.Repository, e encoder) (plumbing.Hash, error) {
+	obj := r.Storer.NewEncodedObject()
+	if err := e.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return r.Storer.SetEncodedObject(obj)
+}
+
+// writeTree stores the contents of dir in the repository, and returns the hash of the tree.
+func writeTree(r *git.Repository, fs billy.Filesystem, dir string) (plumbing.Hash, error) {
+	fis, err := fs.ReadDir(dir)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	tree := &object.Tree{}
+	for _, fi := range fis {
+		fpath := filepath.Join(dir, fi.Name())
+		if fi.IsDir() {
+			hash, err := writeTree(r, fs, fpath)
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+			if hash == emptyTree {
+				// git doesn't store empty dirs
+				continue
+			}
+			tree.Entries = append(tree.Entries, object.TreeEntry{Name: fi.Name(), Mode: filemode.Dir, Hash: hash})
+			continue
+		}
+		hash, err := writeBlob(r, fs, fpath)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		mode := filemode.Regular
+		if fi.Mode()&0111 != 0 {
+			mode = filemode.Executable
+		}
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: fi.Name(), Mode: mode, Hash: hash})
+	}
+	// git orders entries as if dir names had a trailing slash
+	sortName := func(e object.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(tree.Entries, func(i, j int) bool {
+		return sortName(tree.Entries[i]) < sortName(tree.Entries[j])
+	})
+	return writeObject(r, tree)
+}
+
+// emptyTree is the hash of a tree without entries.
+var emptyTree = plumbing.NewHash("4b825dc642cb6eb9a060e54bf8d69288fbee4904")
+
+func writeBlob(r *git.Repository, fs billy.Filesystem, fpath string) (plumbing.Hash, error) {
+	f, err := fs.Open(fpath)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	defer f.Close()
+	obj := r.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		w.Close()
+		return plumbing.ZeroHash, err
+	}
+	if err := w.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return r.Storer.SetEncodedObject(obj)
+}
+
+// treeFS is a read only billy filesystem for a git tree. Objects are read from the repository as
+// they are needed. The git storage isn't safe for concurrent use, so access is serialized.
+type treeFS struct {
+	m    sync.Mutex
+	tree *object.Tree
+}
+
+// gitPath converts a filesystem path to a path in the tree.
+func gitPath(fpath string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(fpath)), "/")
+}
+
+// dir returns the tree for a dir - the root if p is empty.
+func (fs *treeFS) dir(p string) (*object.Tree, error) {
+	if p == "" {
+		return fs.tree, nil
+	}
+	t, err := fs.tree.Tree(p)
+	if err == object.ErrDirectoryNotFound {
+		return nil, os.ErrNotExist
+	}
+	return t, err
+}
+
+func (fs *treeFS) Stat(filename string) (os.FileInfo, error) {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+	p := gitPath(filename)
+	if p == "" {
+		return &treeFileInfo{name: "/", dir: true}, nil
+	}
+	e, err := fs.tree.FindEntry(p)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	return fs.entryInfo(p, e), nil
+}
+
+// entryInfo returns the file info for a tree entry. The size of a file is only read from the
+// repository when it's needed.
+func (fs *treeFS) entryInfo(p string, e *object.TreeEntry) os.FileInfo {
+	if e.Mode == filemode.Dir || e.Mode == filemode.Submodule {
+		return &treeFileInfo{name: e.Name, dir: true}
+	}
+	return &treeFileInfo{name: e.Name, mode: e.Mode, fs: fs, path: p}
+}
+
+func (fs *treeFS) Lstat(filename string) (os.FileInfo, error) {
+	return fs.Stat(filename)
+}
+
+func (fs *treeFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+	p := gitPath(dirname)
+	t, err := fs.dir(p)
+	if err != nil {
+		return nil, err
+	}
+	var infos []os.FileInfo
+	for i := range t.Entries {
+		e := &t.Entries[i]
+		if e.Mode == filemode.Submodule {
+			// submodules are not included in the tree
+			continue
+		}
+		infos = append(infos, fs.entryInfo(path.Join(p, e.Name), e))
+	}
+	return infos, nil
+}
+
+func (fs *treeFS) Open(filename string) (billy.File, error) {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+	f, err := fs.tree.File(gitPath(filename))
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	r, err := f.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return &treeFile{name: filename, Reader: bytes.NewReader(b)}, nil
+}
+
+func (fs *treeFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_TRUNC) != 0 {
+		return nil, billy.ErrReadOnly
+	}
+	return fs.Open(filename)
+}
+
+func (fs *treeFS) Join(elem ...string) string {
+	return filepath.Join(elem...)
+}
+
+func (fs *treeFS) Readlink(link string) (string, error) {
+	return "", billy.ErrNotSupported
+}
+
+func (fs *treeFS) Root() string {
+	return "/"
+}
+
+func (fs *treeFS) Chroot(p string) (billy.Filesystem, error) {
+	return nil, billy.ErrNotSupported
+}
+
+func (fs *treeFS) Create(filename string) (billy.File, error) {
+	return nil, billy.ErrReadOnly
+}
+
+func (fs *treeFS) Rename(oldpath, newpath string) error {
+	return billy.ErrReadOnly
+}
+
+func (fs *treeFS) Remove(filename string) error {
+	return billy.ErrReadOnly
+}
+
+func (fs *treeFS) TempFile(dir, prefix string) (billy.File, error) {
+	return nil, billy.ErrReadOnly
+}
+
+func (fs *treeFS) MkdirAll(filename string, perm os.FileMode) error {
+	return billy.ErrReadOnly
+}
+
+func (fs *treeFS) Symlink(target, link string) error {
+	return billy.ErrReadOnly
+}
+
+type treeFile struct {
+	name string
+	*bytes.Reader
+}
+
+func (f *treeFile) Name() string                { return f.name }
+func (f *treeFile) Write(p []byte) (int, error) { return 0, billy.ErrReadOnly }
+func (f *treeFile) Close() error                { return nil }
+func (f *treeFile) Lock() error                 { return nil }
+func (f *treeFile) Unlock() error               { return nil }
+func (f *treeFile) Truncate(size int64) error   { return billy.ErrReadOnly }
+
+type treeFileInfo struct {
+	name string
+	mode filemode.FileMode
+	dir  bool
+	fs   *treeFS // filesystem and path in the tree to read the size of a file from
+	path string
+}
+
+func (fi *treeFileInfo) Name() string       { return fi.name }
+func (fi *treeFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi *treeFileInfo) IsDir() bool        { return fi.dir }
+func (fi *treeFileInfo) Sys() interface{}   { return nil }
+
+// Size reads the size of a file from the repository, or returns 0 if it can't be read.
+func (fi *treeFileInfo) Size() int64 {
+	if fi.dir {
+		return 0
+	}
+	fi.fs.m.Lock()
+	defer fi.fs.m.Unlock()
+	size, err := fi.fs.tree.Size(fi.path)
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+func (fi *treeFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	m, err := fi.mode.ToOSFileMode()
+	if err != nil {
+		return 0644
+	}
+	return m
+}
@@ -0,0 +1,218 @@
+package forky
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+func TestReadGit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(files map[string]string) {
+		for fpath, contents := range files {
+			full := filepath.Join(dir, fpath)
+			if err := os.MkdirAll(filepath.Dir(full), 0777); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(full, []byte(contents), 0666); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := wt.Add(fpath); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sig := &object.Signature{Name: "a", Email: "a@a", When: time.Now()}
+		if _, err := wt.Commit("commit", &git.CommitOptions{Author: sig}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit(map[string]string{
+		"a/a.go":   "package a\n\nvar A = \"v1\"\n",
+		"a/a.txt":  "v1\n",
+		".gitkeep": "",
+	})
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateTag("v1", head.Hash(), nil); err != nil {
+		t.Fatal(err)
+	}
+	commit(map[string]string{
+		"a/a.go": "package a\n\nvar A = \"v2\"\n",
+		"b/b.go": "package b\n",
+	})
+	// uncommitted changes in the working copy are ignored
+	if err := ioutil.WriteFile(filepath.Join(dir, "a/a.go"), []byte("package a\n\nvar A = \"v3\"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	for rev, expected := range map[string]string{"v1": "v1", "master": "v2", "HEAD~1": "v1"} {
+		s := NewSession("", "", "")
+		s.Observer = NewTextObserver(&bytes.Buffer{})
+		s.fs = newMemFS()
+		s.outdir = "/out"
+		if err := s.ReadGit(dir, rev); err != nil {
+			t.Fatalf("%s: %v", rev, err)
+		}
+		if err := s.Run(nil); err != nil {
+			t.Fatalf("%s: %v", rev, err)
+		}
+		if err := s.Save(); err != nil {
+			t.Fatalf("%s: %v", rev, err)
+		}
+		found, err := readFile(s.fs, "/out/a/a.go")
+		if err != nil {
+			t.Fatalf("%s: %v", rev, err)
+		}
+		if string(found) != "package a\n\nvar A = \""+expected+"\"\n" {
+			t.Fatalf("%s: unexpected a.go:\n%s", rev, string(found))
+		}
+		if _, err := s.fs.Stat("/out/b/b.go"); (err == nil) != (expected == "v2") {
+			t.Fatalf("%s: b.go should only exist in v2", rev)
+		}
+		if _, err := s.fs.Stat("/out/a/a.txt"); err != nil {
+			t.Fatalf("%s: %v", rev, err)
+		}
+	}
+
+	// a source dir in the repository is read from the same dir of the tree
+	s := NewSession(filepath.Join(dir, "a"), "", "")
+	s.Observer = NewTextObserver(&bytes.Buffer{})
+	s.fs = newMemFS()
+	s.outdir = "/out"
+	if err := s.ReadGit(dir, "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	found, err := readFile(s.fs, "/out/a.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(found) != "package a\n\nvar A = \"v1\"\n" {
+		t.Fatalf("unexpected a.go:\n%s", string(found))
+	}
+	fis, err := s.srcFS().ReadDir("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 2 || fis[0].Name() != "a.go" || fis[0].Size() != int64(len(found)) {
+		t.Fatalf("unexpected dir listing %v", fis)
+	}
+	if err := NewSession(filepath.Join(dir, "b"), "", "").ReadGit(dir, "v1"); err == nil {
+		t.Fatal("expected an error for a dir that isn't in the tree")
+	}
+}
+
+func TestSaveGit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(contents string) *Session {
+		s := NewSession("/", "a.com/a", "")
+		s.Observer = NewTextObserver(&bytes.Buffer{})
+		s.gopathsrc = "/"
+		s.fs = memfs.New()
+		if err := util.WriteFile(s.fs, "/a/a.go", []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := util.WriteFile(s.fs, "/a/b/run.sh", []byte("run\n"), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Run([]Mutator{ModifyStrings(func(s string) string { return s + "!" })}); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	save := func(contents string) *object.Commit {
+		hash, err := run(contents).SaveGit(dir, "golib", object.Signature{Name: "a", Email: "a@a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return commit
+	}
+
+	first := save("package a\n\nvar A = \"a\"\n")
+	second := save("package a\n\nvar A = \"b\"\n")
+
+	if len(first.ParentHashes) != 0 || len(second.ParentHashes) != 1 || second.ParentHashes[0] != first.Hash {
+		t.Fatal("unexpected parents")
+	}
+	ref, err := repo.Reference("refs/heads/golib", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Hash() != second.Hash {
+		t.Fatalf("branch should point to %s, got %s", second.Hash, ref.Hash())
+	}
+	expected := "forky: a.com/a\n\nMutators:\n\tforky.ModifyStrings\n"
+	if second.Message != expected {
+		t.Fatalf("unexpected message:\n%s", second.Message)
+	}
+	f, err := second.File("a/a.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := f.Contents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents != "package a\n\nvar A = \"b!\"\n" {
+		t.Fatalf("unexpected a.go:\n%s", contents)
+	}
+	if _, err := second.File("a/b/run.sh"); err != nil {
+		t.Fatal(err)
+	}
+	// the working copy is not changed
+	if _, err := os.Stat(filepath.Join(dir, "a")); !os.IsNotExist(err) {
+		t.Fatal("working copy should not be changed")
+	}
+
+	// the checked out branch is only changed if Force is set
+	s := run("package a\n")
+	if _, err := s.SaveGit(dir, "master", object.Signature{Name: "a", Email: "a@a"}); err == nil || !strings.HasPrefix(err.Error(), "branch master is checked out") {
+		t.Fatalf("expected checked out error, got %v", err)
+	}
+	s.Force = true
+	if _, err := s.SaveGit(dir, "master", object.Signature{Name: "a", Email: "a@a"}); err != nil {
+		t.Fatal(err)
+	}
+}
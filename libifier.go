@@ -2,30 +2,37 @@ package forky
 
 import (
 	"fmt"
-	"go/ast"
 	"go/token"
 	"go/types"
+	"path"
+	"path/filepath"
 	"sort"
 
 	"github.com/dave/dst"
 	"github.com/dave/dst/dstutil"
+	"golang.org/x/tools/go/packages"
 	"golang.org/x/tools/go/pointer"
 	"golang.org/x/tools/go/ssa"
 	"golang.org/x/tools/go/ssa/ssautil"
 )
 
 type Libifier struct {
-	libify   Libify
-	session  *Session
-	packages map[string]*LibifyPackage
-	ssa      *ssa.Program
-
-	varObjects    map[types.Object]bool
-	methodObjects map[types.Object]bool
-	funcObjects   map[types.Object]bool
-
-	varUses    map[types.Object]map[types.Object]bool // func object -> var objects
-	funcUses   map[types.Object]map[types.Object]bool // func object -> func objects
+	libify    Libify
+	session   *Session
+	packages  map[string]*LibifyPackage          // packages for the platform being processed
+	infos     map[string]map[string]*PackageInfo // type checked packages for the platform being processed
+	pkgs      []*packages.Package                // loaded packages for the platform being processed
+	platforms []map[string]*LibifyPackage        // packages for each platform
+	ssa       *ssa.Program
+
+	// Objects are stored by key (see Libifier.key) so the results for several platforms can be
+	// combined.
+	varObjects    map[string]bool
+	methodObjects map[string]bool
+	funcObjects   map[string]bool
+
+	varUses    map[string]map[string]bool // func key -> var keys
+	funcUses   map[string]map[string]bool // func key -> func keys
 	varMutated map[types.Object]bool
 }
 
@@ -35,12 +42,12 @@ func NewLibifier(l Libify, s *Session) *Libifier {
 		session:  s,
 		packages: map[string]*LibifyPackage{},
 
-		varObjects:    map[types.Object]bool{},
-		methodObjects: map[types.Object]bool{},
-		funcObjects:   map[types.Object]bool{},
+		varObjects:    map[string]bool{},
+		methodObjects: map[string]bool{},
+		funcObjects:   map[string]bool{},
 
-		varUses:    map[types.Object]map[types.Object]bool{},
-		funcUses:   map[types.Object]map[types.Object]bool{},
+		varUses:    map[string]map[string]bool{},
+		funcUses:   map[string]map[string]bool{},
 		varMutated: map[types.Object]bool{},
 	}
 }
@@ -53,6 +60,7 @@ type LibifyPackage struct {
 	path        string
 	sessionFile *dst.File
 	ssa         *ssa.Package
+	variants    []*LibifyPackage // the package on every platform it's loaded on (only set on the first)
 
 	vars    map[*dst.GenDecl]bool
 	methods map[*dst.FuncDecl]bool
@@ -64,6 +72,15 @@ type LibifyPackage struct {
 	varMutated map[types.Object]bool
 }
 
+// errorf returns an error at a node in a file of the package.
+func (p *LibifyPackage) errorf(fname string, node dst.Node, format string, args ...interface{}) *Error {
+	pos := token.Position{Filename: filepath.Join(p.session.dir, p.relpath, fname)}
+	if n := p.NodesAst[node]; n != nil {
+		pos = p.session.position(p.relpath, fname, n.Pos())
+	}
+	return &Error{Pos: pos, Err: fmt.Errorf(format, args...)}
+}
+
 type declspec struct {
 	typ    dst.Expr
 	names  []*dst.Ident
@@ -89,25 +106,40 @@ func (l *Libifier) NewLibifyPackage(rel, path string, info *PackageInfo) *Libify
 
 func (l *Libifier) Run() error {
 
-	fmt.Println("")
+	platforms := l.libify.Platforms
+	if len(platforms) == 0 {
+		platforms = []Platform{{}}
+	}
 
-	fmt.Println("load()")
-	l.session.load()
+	events := l.session.events
 
-	fmt.Println("scanDeps()")
-	if err := l.scanDeps(); err != nil {
-		return err
-	}
+	// Vars, funcs and their uses are collected for all platforms before any files are changed, so
+	// every file is updated using the union of the results.
+	for _, p := range platforms {
 
-	fmt.Println("findVars()")
-	// finds all package level vars, populates vars, varObjects
-	if err := l.findVars(); err != nil {
-		return err
-	}
+		if err := l.load(p); err != nil {
+			return err
+		}
 
-	fmt.Println("findVarUses()")
-	if err := l.findVarUses(); err != nil {
-		return err
+		phase := "Finding vars " + p.String()
+		events.PhaseStart(phase, 0)
+
+		if err := l.scanDeps(); err != nil {
+			return err
+		}
+
+		// finds all package level vars, populates vars, varObjects
+		if err := l.findVars(); err != nil {
+			return err
+		}
+
+		if err := l.findVarUses(); err != nil {
+			return err
+		}
+
+		events.PhaseEnd(phase)
+
+		l.platforms = append(l.platforms, l.packages)
 	}
 
 	/*
@@ -138,14 +170,20 @@ func (l *Libifier) Run() error {
 	//	return err
 	//}
 
-	// finds all package level funcs and methods, populates methods, funcs, methodObjects, funcObjects
-	if err := l.findFuncs(); err != nil {
-		return err
-	}
+	// files included on several platforms are only updated on the first
+	l.assignFiles()
 
-	// deletes all vars, adds receiver to all funcs and adds a new param to all methods.
-	if err := l.updateDecls(); err != nil {
-		return err
+	for _, l.packages = range l.platforms {
+
+		// finds all package level funcs and methods, populates methods, funcs, methodObjects, funcObjects
+		if err := l.findFuncs(); err != nil {
+			return err
+		}
+
+		// deletes all vars, adds receiver to all funcs and adds a new param to all methods.
+		if err := l.updateDecls(); err != nil {
+			return err
+		}
 	}
 
 	// creates package-state.go
@@ -153,24 +191,132 @@ func (l *Libifier) Run() error {
 		return err
 	}
 
-	// updates usage of vars and funcs to the field of the package state
-	if err := l.updateVarFuncUsage(); err != nil {
-		return err
+	for _, l.packages = range l.platforms {
+
+		// updates usage of vars and funcs to the field of the package state
+		if err := l.updateVarFuncUsage(); err != nil {
+			return err
+		}
+
+		if err := l.updateMethodUsage(); err != nil {
+			return err
+		}
+
+		if err := l.updateSelectorUsage(); err != nil {
+			return err
+		}
 	}
 
-	if err := l.updateMethodUsage(); err != nil {
+	l.updateSession()
+
+	return nil
+}
+
+// load type checks the session for a platform, and resets the packages for the platform.
+func (l *Libifier) load(p Platform) error {
+	infos, pkgs, err := l.session.typecheck(p, false)
+	if err != nil {
 		return err
 	}
+	l.infos = infos
+	l.pkgs = pkgs
+	l.packages = map[string]*LibifyPackage{}
+	return nil
+}
 
-	if err := l.updateSelectorUsage(); err != nil {
-		return err
+// key returns a key for an object that is stable across type checker runs, so objects from
+// several platforms can be matched. Package level objects and methods are keyed by name (and
+// receiver type), so the variants of a func or var declared in different platform files share a
+// key. Other objects are keyed by their declaration position (all platforms load the same source).
+func (l *Libifier) key(ob types.Object) string {
+	if ob == nil {
+		return ""
+	}
+	if ob.Pkg() == nil || !ob.Pos().IsValid() {
+		return ob.Name()
 	}
+	if ob.Parent() == ob.Pkg().Scope() {
+		return ob.Pkg().Path() + "." + ob.Name()
+	}
+	if f, ok := ob.(*types.Func); ok {
+		if recv := f.Type().(*types.Signature).Recv(); recv != nil {
+			t := recv.Type()
+			if p, ok := t.(*types.Pointer); ok {
+				t = p.Elem()
+			}
+			if named, ok := t.(*types.Named); ok {
+				return ob.Pkg().Path() + "." + named.Obj().Name() + "." + ob.Name()
+			}
+		}
+	}
+	pos := l.session.fset.Position(ob.Pos())
+	return fmt.Sprintf("%s/%s:%d:%d", ob.Pkg().Path(), filepath.Base(pos.Filename), pos.Line, pos.Column)
+}
 
-	return nil
+// defaultPackage returns the type checked default package in relpath for the platform being
+// processed.
+func (l *Libifier) defaultPackage(relpath string) *PackageInfo {
+	info, ok := l.session.paths[relpath]
+	if !ok || info.Default == nil {
+		return nil
+	}
+	return l.infos[relpath][info.Default.Name]
+}
+
+// assignFiles removes files from all but the first platform they are included on, so each file is
+// only updated once.
+func (l *Libifier) assignFiles() {
+	done := map[string]bool{}
+	for _, packages := range l.platforms {
+		for relpath, pkg := range packages {
+			for fname := range pkg.Files {
+				fpath := path.Join(relpath, fname)
+				if done[fpath] {
+					delete(pkg.Files, fname)
+					continue
+				}
+				done[fpath] = true
+			}
+		}
+	}
+}
+
+// updateSession copies the updated files back to the session.
+func (l *Libifier) updateSession() {
+	done := map[string]bool{}
+	for _, packages := range l.platforms {
+		for relpath, pkg := range packages {
+			target := l.session.paths[relpath].Packages[pkg.Name]
+			for fname, file := range pkg.Files {
+				target.Files[fname] = file
+				l.session.managed[file] = true
+			}
+			if !done[relpath] {
+				target.Info = pkg.Info
+				target.NodesDst = pkg.NodesDst
+				target.NodesAst = pkg.NodesAst
+				done[relpath] = true
+			}
+		}
+	}
+}
+
+// libified returns true if the package is libified on any platform.
+func (l *Libifier) libified(path string) bool {
+	relpath, ok := l.session.Rel(path)
+	if !ok {
+		return false
+	}
+	for _, packages := range l.platforms {
+		if packages[relpath] != nil {
+			return true
+		}
+	}
+	return false
 }
 
-func (l *Libifier) includeVar(ob types.Object) bool {
-	if !l.varObjects[ob] {
+func (l *Libifier) includeVar(key string) bool {
+	if !l.varObjects[key] {
 		return false
 	}
 	//if !l.varMutated[ob] {
@@ -200,16 +346,16 @@ func (l *Libifier) scanDeps() error {
 			if !ok {
 				continue
 			}
-			info, ok := l.session.paths[relpath]
-			if !ok {
+			info := l.defaultPackage(relpath)
+			if info == nil {
 				continue
 			}
-			scan(info.Default)
-			l.packages[relpath] = l.NewLibifyPackage(relpath, imported.Path(), info.Default)
+			scan(info)
+			l.packages[relpath] = l.NewLibifyPackage(relpath, imported.Path(), info)
 		}
 	}
 	for _, relpath := range l.libify.Packages {
-		info := l.session.paths[relpath].Default
+		info := l.defaultPackage(relpath)
 		if info == nil {
 			return fmt.Errorf("no default package for %s", relpath)
 		}
@@ -226,8 +372,9 @@ func (l *Libifier) findVars() error {
 
 	// TODO: exclude vars that are never modified
 
+	var errs ErrorList
 	for _, pkg := range l.packages {
-		for _, file := range pkg.Files {
+		for fname, file := range pkg.Files {
 			dstutil.Apply(file, func(c *dstutil.Cursor) bool {
 				switch n := c.Node().(type) {
 				case *dst.GenDecl:
@@ -248,11 +395,12 @@ func (l *Libifier) findVars() error {
 							if id.Name == "_" {
 								continue
 							}
-							def, ok := pkg.Info.Defs[pkg.NodesAst[id].(*ast.Ident)]
+							def, ok := pkg.Info.Defs[pkg.NodesAst.Ident(id)]
 							if !ok {
-								panic(fmt.Sprintf("can't find %s in defs", id.Name))
+								errs.Add(pkg.errorf(fname, id, "can't find %s in defs", id.Name))
+								continue
 							}
-							pkg.libifier.varObjects[def] = true
+							pkg.libifier.varObjects[l.key(def)] = true
 							pkg.varObjects[def] = true
 						}
 					}
@@ -261,19 +409,23 @@ func (l *Libifier) findVars() error {
 			}, nil)
 		}
 	}
-	return nil
+	errs.Sort()
+	return errs.Err()
 }
 
 func (l *Libifier) findVarUses() error {
+	var errs ErrorList
 	for _, pkg := range l.packages {
-		for _, file := range pkg.Files {
+		for fname, file := range pkg.Files {
 			dstutil.Apply(file, func(c *dstutil.Cursor) bool {
 				switch decl := c.Node().(type) {
 				case *dst.FuncDecl:
-					obj, ok := pkg.Info.Defs[pkg.NodesAst.Ident(decl.Name)]
+					def, ok := pkg.Info.Defs[pkg.NodesAst.Ident(decl.Name)]
 					if !ok {
-						panic("func not found in defs " + decl.Name.Name)
+						errs.Add(pkg.errorf(fname, decl.Name, "func not found in defs %s", decl.Name.Name))
+						return false
 					}
+					obj := l.key(def)
 					dstutil.Apply(decl.Body, func(c *dstutil.Cursor) bool {
 						switch n := c.Node().(type) {
 						case *dst.Ident:
@@ -284,19 +436,19 @@ func (l *Libifier) findVarUses() error {
 							if !ok {
 								return true
 							}
-							if l.varObjects[use] {
+							if l.varObjects[l.key(use)] {
 								if l.varUses[obj] == nil {
-									l.varUses[obj] = map[types.Object]bool{}
+									l.varUses[obj] = map[string]bool{}
 								}
-								l.varUses[obj][use] = true
+								l.varUses[obj][l.key(use)] = true
 								return true
 							}
 							// funcs?
 							if _, ok := use.Type().Underlying().(*types.Signature); ok {
 								if l.funcUses[obj] == nil {
-									l.funcUses[obj] = map[types.Object]bool{}
+									l.funcUses[obj] = map[string]bool{}
 								}
-								l.funcUses[obj][use] = true
+								l.funcUses[obj][l.key(use)] = true
 							}
 
 						}
@@ -307,12 +459,13 @@ func (l *Libifier) findVarUses() error {
 			}, nil)
 		}
 	}
-	return nil
+	errs.Sort()
+	return errs.Err()
 }
 
 // analyze created the ssa program and performs pointer analysis
 func (l *Libifier) analyzeSSA() error {
-	l.ssa = ssautil.CreateProgram(l.session.prog, 0)
+	l.ssa, _ = ssautil.AllPackages(l.pkgs, 0)
 	for _, pkg := range l.ssa.AllPackages() {
 		pkg.Build()
 		p := l.packageFromPath(pkg.Pkg.Path())
@@ -450,12 +603,12 @@ func (l *Libifier) findVarMutations() error {
 	}
 
 	// Run the pointer analysis.
-	fmt.Print("pointer.Analyze...")
+	l.session.events.PhaseStart("Pointer analysis", 0)
 	result, err := pointer.Analyze(config)
 	if err != nil {
 		return err // internal error in pointer analysis
 	}
-	fmt.Println(" done")
+	l.session.events.PhaseEnd("Pointer analysis")
 
 	for _, q := range result.Queries {
 		for _, label := range q.PointsTo().Labels() {
@@ -589,25 +742,24 @@ func (l *Libifier) findFuncs() error {
 
 	// TODO: exclude funcs that don't need access to package level vars or funcs
 
+	var errs ErrorList
 	for _, pkg := range l.packages {
-		for _, file := range pkg.Files {
+		for fname, file := range pkg.Files {
 			dstutil.Apply(file, func(c *dstutil.Cursor) bool {
 				switch n := c.Node().(type) {
 				case *dst.FuncDecl:
 
 					def, ok := pkg.Info.Defs[pkg.NodesAst.Ident(n.Name)]
 					if !ok {
-						panic(fmt.Sprintf("can't find %s in defs", n.Name.Name))
+						errs.Add(pkg.errorf(fname, n.Name, "can't find %s in defs", n.Name.Name))
+						return false
 					}
 
 					// inspect the callgraph to see if this or any callees use package level vars
 					var found bool
-					done := map[types.Object]bool{}
-					var inspect func(obj types.Object)
-					inspect = func(obj types.Object) {
-						if obj == nil {
-							return
-						}
+					done := map[string]bool{}
+					var inspect func(obj string)
+					inspect = func(obj string) {
 						if done[obj] {
 							return
 						}
@@ -631,7 +783,7 @@ func (l *Libifier) findFuncs() error {
 							inspect(callee)
 						}
 					}
-					inspect(def)
+					inspect(l.key(def))
 
 					if !found {
 						// call graph doesn't contain any var uses, so we can skip this function
@@ -641,7 +793,7 @@ func (l *Libifier) findFuncs() error {
 					if n.Recv != nil && len(n.Recv.List) > 0 {
 						// method
 						pkg.methods[n] = true
-						pkg.libifier.methodObjects[def] = true
+						pkg.libifier.methodObjects[l.key(def)] = true
 						/*
 							// Print list of types that have methods that need package state
 							recvTyp := pkg.Info.Types[n.Recv.List[0].Type].Type
@@ -673,7 +825,7 @@ func (l *Libifier) findFuncs() error {
 					} else {
 						// function
 						pkg.funcs[n] = true
-						pkg.libifier.funcObjects[def] = true
+						pkg.libifier.funcObjects[l.key(def)] = true
 					}
 					c.Replace(n)
 				}
@@ -681,7 +833,8 @@ func (l *Libifier) findFuncs() error {
 			}, nil)
 		}
 	}
-	return nil
+	errs.Sort()
+	return errs.Err()
 }
 
 //var typesList = map[types.Type]bool{}
@@ -704,7 +857,7 @@ func (l *Libifier) updateDecls() error {
 						var valuesMoved []dst.Expr
 						for i, name := range spec.Names {
 							ob := pkg.Info.Defs[pkg.NodesAst.Ident(name)]
-							if !l.includeVar(ob) {
+							if !l.includeVar(l.key(ob)) {
 								// definitions of vars that are included in the package state should
 								// be deleted, so only append the name if it's not included
 								names = append(names, name)
@@ -775,12 +928,34 @@ func (l *Libifier) updateDecls() error {
 }
 
 func (l *Libifier) createStateFiles() error {
-	for _, pkg := range l.packages {
+	// one package state is created for each package, combining the package on all platforms
+	var ordered []*LibifyPackage
+	for _, packages := range l.platforms {
+		for relpath, pkg := range packages {
+			var first *LibifyPackage
+			for _, p := range ordered {
+				if p.relpath == relpath {
+					first = p
+					break
+				}
+			}
+			if first == nil {
+				first = pkg
+				ordered = append(ordered, pkg)
+			}
+			first.variants = append(first.variants, pkg)
+		}
+	}
+
+	for _, pkg := range ordered {
 
 		pkg.sessionFile = &dst.File{
 			Name: dst.NewIdent(pkg.Info.Pkg.Name()),
 		}
 		pkg.Files["package-state.go"] = pkg.sessionFile
+		for _, v := range pkg.variants {
+			v.sessionFile = pkg.sessionFile
+		}
 
 		if err := pkg.addPackageStateStruct(); err != nil {
 			return err
@@ -807,9 +982,28 @@ func (pkg *LibifyPackage) addPackageStateStruct() error {
 	})
 	fields = append(fields, importFields...)
 
-	varFields, err := pkg.generatePackageStateVarFields()
-	if err != nil {
-		return err
+	var varFields []*dst.Field
+	done := map[string]bool{}
+	for _, v := range pkg.variants {
+		fields, err := v.generatePackageStateVarFields()
+		if err != nil {
+			return err
+		}
+		for _, f := range fields {
+			// vars declared with the same name on several platforms share a field
+			var names []*dst.Ident
+			for _, name := range f.Names {
+				if !done[name.Name] {
+					names = append(names, name)
+					done[name.Name] = true
+				}
+			}
+			if len(names) == 0 {
+				continue
+			}
+			f.Names = names
+			varFields = append(varFields, f)
+		}
 	}
 	sort.Slice(varFields, func(i, j int) bool {
 		return varFields[i].Names[0].Name < varFields[j].Names[0].Name
@@ -835,7 +1029,7 @@ func (pkg *LibifyPackage) addPackageStateStruct() error {
 func (pkg *LibifyPackage) generatePackageStateImportFields() ([]*dst.Field, error) {
 	// foo *foo.PackageState
 	var fields []*dst.Field
-	for _, imp := range pkg.Info.Pkg.Imports() {
+	for _, imp := range pkg.imports() {
 		f := &dst.Field{
 			Names: []*dst.Ident{dst.NewIdent(imp.Name())},
 			Type: &dst.StarExpr{
@@ -928,7 +1122,7 @@ func (pkg *LibifyPackage) addNewPackageStateFunc() error {
 func (pkg *LibifyPackage) generateNewPackageStateFuncParams() ([]*dst.Field, error) {
 	var params []*dst.Field
 	// b_pstate *b.PackageState
-	for _, imp := range pkg.Info.Pkg.Imports() {
+	for _, imp := range pkg.imports() {
 		f := &dst.Field{
 			Names: []*dst.Ident{dst.NewIdent(fmt.Sprintf("%s_pstate", imp.Name()))},
 			Type: &dst.StarExpr{
@@ -960,9 +1154,8 @@ func (pkg *LibifyPackage) generateNewPackageStateFuncBody() ([]dst.Stmt, error)
 
 	// Assign the injected package state for all imported packages
 	// pstate.foo = foo_pstate
-	for _, imp := range pkg.Info.Pkg.Imports() {
-		impPkg := pkg.libifier.packageFromPath(imp.Path())
-		if impPkg == nil {
+	for _, imp := range pkg.imports() {
+		if !pkg.libifier.libified(imp.Path()) {
 			continue
 		}
 		body = append(body, &dst.AssignStmt{
@@ -979,25 +1172,30 @@ func (pkg *LibifyPackage) generateNewPackageStateFuncBody() ([]dst.Stmt, error)
 		})
 	}
 
-	// Initialise the vars in init order
-	for _, i := range pkg.Info.InitOrder {
-		for _, v := range i.Lhs {
-			if v.Name() == "_" {
-				continue
-			}
-			if !pkg.libifier.includeVar(v) {
-				continue
-			}
-			body = append(body, &dst.AssignStmt{
-				Lhs: []dst.Expr{
-					&dst.SelectorExpr{
-						X:   dst.NewIdent("pstate"),
-						Sel: dst.NewIdent(v.Name()),
+	// Initialise the vars in init order. Vars only declared on later platforms are initialised
+	// after the vars of the first.
+	done := map[string]bool{}
+	for _, variant := range pkg.variants {
+		for _, i := range variant.Info.InitOrder {
+			for _, v := range i.Lhs {
+				if v.Name() == "_" || done[v.Name()] {
+					continue
+				}
+				if !pkg.libifier.includeVar(pkg.libifier.key(v)) {
+					continue
+				}
+				done[v.Name()] = true
+				body = append(body, &dst.AssignStmt{
+					Lhs: []dst.Expr{
+						&dst.SelectorExpr{
+							X:   dst.NewIdent("pstate"),
+							Sel: dst.NewIdent(v.Name()),
+						},
 					},
-				},
-				Tok: token.ASSIGN,
-				Rhs: []dst.Expr{dst.Clone(pkg.NodesDst.Expr(i.Rhs)).(dst.Expr)},
-			})
+					Tok: token.ASSIGN,
+					Rhs: []dst.Expr{dst.Clone(variant.NodesDst.Expr(i.Rhs)).(dst.Expr)},
+				})
+			}
 		}
 	}
 
@@ -1022,7 +1220,7 @@ func (l *Libifier) updateVarFuncUsage() error {
 					if !ok {
 						return true
 					}
-					if pkg.libifier.includeVar(use) || pkg.libifier.funcObjects[use] {
+					if pkg.libifier.includeVar(pkg.libifier.key(use)) || pkg.libifier.funcObjects[pkg.libifier.key(use)] {
 						if use.Pkg().Path() != pkg.path {
 							// This is only for if the object is in the local package. Without this,
 							// we trigger on the "a" part of foo.a where foo is another package.
@@ -1062,7 +1260,7 @@ func (l *Libifier) updateMethodUsage() error {
 						return true
 					}
 
-					if pkg.libifier.methodObjects[use] {
+					if pkg.libifier.methodObjects[pkg.libifier.key(use)] {
 						if use.Pkg().Path() == pkg.path {
 							n.Args = append([]dst.Expr{dst.NewIdent("pstate")}, n.Args...)
 						} else {
@@ -1101,7 +1299,7 @@ func (l *Libifier) updateSelectorUsage() error {
 					if !ok {
 						return true
 					}
-					if pkg.libifier.varObjects[use] || pkg.libifier.funcObjects[use] {
+					if pkg.libifier.varObjects[pkg.libifier.key(use)] || pkg.libifier.funcObjects[pkg.libifier.key(use)] {
 						pkgName := pkg.Name
 						newNode := &dst.SelectorExpr{
 							X: &dst.SelectorExpr{
@@ -1147,6 +1345,22 @@ func (l *Libifier) addPstateToTypes() error {
 }
 */
 
+// imports returns the packages imported by the package on any platform.
+func (pkg *LibifyPackage) imports() []*types.Package {
+	var imports []*types.Package
+	done := map[string]bool{}
+	for _, v := range pkg.variants {
+		for _, imp := range v.Info.Pkg.Imports() {
+			if done[imp.Path()] {
+				continue
+			}
+			done[imp.Path()] = true
+			imports = append(imports, imp)
+		}
+	}
+	return imports
+}
+
 func (l *Libifier) packageFromPath(path string) *LibifyPackage {
 	relpath, ok := l.session.Rel(path)
 	if !ok {
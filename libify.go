@@ -2,20 +2,15 @@ package forky
 
 import (
 	"fmt"
-	"go/build"
 	"go/token"
 	"go/types"
-	"io"
-	"os"
-	"path/filepath"
-	"strings"
 
 	"github.com/dave/dst"
-	"gopkg.in/src-d/go-billy.v4"
 )
 
 type Libify struct {
-	Packages []string
+	Packages  []string
+	Platforms []Platform // platforms to type check - defaults to the host platform
 }
 
 func (m Libify) Apply(s *Session) Applier {
@@ -24,7 +19,7 @@ func (m Libify) Apply(s *Session) Applier {
 
 			l := NewLibifier(m, s)
 			if err := l.Run(); err != nil {
-				panic(err)
+				s.report(err)
 			}
 
 		},
@@ -32,81 +27,6 @@ func (m Libify) Apply(s *Session) Applier {
 
 }
 
-func buildContext(gorootfs, gopathfs billy.Filesystem, gopathrel string, tags ...string) *build.Context {
-	b := &build.Context{
-		GOARCH:      build.Default.GOARCH, // Target architecture
-		GOOS:        build.Default.GOOS,   // Target operating system
-		GOROOT:      "goroot",             // Go root
-		GOPATH:      "gopath",             // Go path
-		Compiler:    "gc",                 // Compiler to assume when computing target paths
-		BuildTags:   tags,                 // Build tags
-		CgoEnabled:  true,                 // Builder only: detect `import "C"` to throw proper error
-		ReleaseTags: build.Default.ReleaseTags,
-
-		// IsDir reports whether the path names a directory.
-		// If IsDir is nil, Import calls os.Stat and uses the result's IsDir method.
-		IsDir: func(path string) bool {
-			fs := filesystem(path, gorootfs, gopathfs, gopathrel)
-			fi, err := fs.Stat(path)
-			return err == nil && fi.IsDir()
-		},
-
-		// HasSubdir reports whether dir is lexically a subdirectory of
-		// root, perhaps multiple levels below. It does not try to check
-		// whether dir exists.
-		// If so, HasSubdir sets rel to a slash-separated path that
-		// can be joined to root to produce a path equivalent to dir.
-		// If HasSubdir is nil, Import uses an implementation built on
-		// filepath.EvalSymlinks.
-		HasSubdir: func(root, dir string) (rel string, ok bool) {
-			// copied from default implementation to prevent use of filepath.EvalSymlinks
-			const sep = string(filepath.Separator)
-			root = filepath.Clean(root)
-			if !strings.HasSuffix(root, sep) {
-				root += sep
-			}
-			dir = filepath.Clean(dir)
-			if !strings.HasPrefix(dir, root) {
-				return "", false
-			}
-			return filepath.ToSlash(dir[len(root):]), true
-		},
-
-		// ReadDir returns a slice of os.FileInfo, sorted by Name,
-		// describing the content of the named directory.
-		// If ReadDir is nil, Import uses ioutil.ReadDir.
-		ReadDir: func(dir string) ([]os.FileInfo, error) {
-			fs := filesystem(dir, gorootfs, gopathfs, gopathrel)
-			return fs.ReadDir(dir)
-		},
-
-		// OpenFile opens a file (not a directory) for reading.
-		// If OpenFile is nil, Import uses os.Open.
-		OpenFile: func(path string) (io.ReadCloser, error) {
-			dir, _ := filepath.Split(path)
-			fs := filesystem(dir, gorootfs, gopathfs, gopathrel)
-			return fs.Open(path)
-		},
-	}
-	return b
-}
-
-// Gets either sourcefs, rootfs or pathfs depending on the path, and if the package is part of source
-func filesystem(dir string, gorootfs, gopathfs billy.Filesystem, gopathrel string) billy.Filesystem {
-
-	dir = strings.Trim(filepath.Clean(dir), string(filepath.Separator))
-	parts := strings.Split(dir, string(filepath.Separator))
-
-	switch parts[0] {
-	case "gopath":
-		return gopathfs
-	case "goroot":
-		return gorootfs
-	}
-
-	panic(fmt.Sprintf("Top dir should be goroot or gopath, got %s", dir))
-}
-
 // Expr for TypeSpec.Type: Should return *Ident, *ParenExpr, *SelectorExpr, *StarExpr, or any of the *XxxTypes
 func (l *LibifyPackage) typeToAstTypeSpec(t types.Type, path string, f *dst.File) dst.Expr {
 	switch t := t.(type) {
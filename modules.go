@@ -0,0 +1,81 @@
+package forky
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/dave/services/fsutil"
+	"golang.org/x/mod/modfile"
+	"gopkg.in/src-d/go-billy.v4"
+)
+
+// NewModuleSession creates a session that reads the Go module rooted at dir. The source path is
+// read from the module statement in dir/go.mod. Save writes the output to outdir, with the module
+// path in go.mod rewritten to destination.
+func NewModuleSession(dir, outdir, destination string) *Session {
+	s := NewSession(dir, "", destination)
+	s.outdir = outdir
+	s.modules = true
+	return s
+}
+
+// readModFile parses go.mod in the source dir, and sets the source path to the module path.
+func (s *Session) readModFile() error {
+	fpath := filepath.Join(s.dir, "go.mod")
+	b, err := readFile(s.srcFS(), fpath)
+	if err != nil {
+		return err
+	}
+	f, err := modfile.Parse(fpath, b, nil)
+	if err != nil {
+		return err
+	}
+	if f.Module == nil {
+		return fmt.Errorf("no module statement in %s", fpath)
+	}
+	s.modfile = f
+	s.source = f.Module.Mod.Path
+	return nil
+}
+
+// formatModFile returns the source go.mod with the module path changed to the destination, for a
+// module rooted at dir. Require lines are carried over unchanged, and relative replacement paths
+// are rewritten so they still point at the same directory from dir.
+func (s *Session) formatModFile(dir string) ([]byte, error) {
+	f, err := modfile.Parse("go.mod", modfile.Format(s.modfile.Syntax), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.AddModuleStmt(s.destination); err != nil {
+		return nil, err
+	}
+	for _, r := range f.Replace {
+		if r.New.Version != "" || filepath.IsAbs(r.New.Path) {
+			continue
+		}
+		rel, err := filepath.Rel(dir, filepath.Join(s.dir, r.New.Path))
+		if err != nil {
+			return nil, err
+		}
+		rel = filepath.ToSlash(rel)
+		if !strings.HasPrefix(rel, "../") {
+			rel = "./" + rel
+		}
+		if err := f.AddReplace(r.Old.Path, r.Old.Version, rel, ""); err != nil {
+			return nil, err
+		}
+	}
+	f.Cleanup()
+	return modfile.Format(f.Syntax), nil
+}
+
+// writeModFile writes the rewritten go.mod to the output, for a module rooted at dir.
+func (s *Session) writeModFile(fs billy.Filesystem, fpath, dir string) error {
+	b, err := s.formatModFile(dir)
+	if err != nil {
+		return err
+	}
+	return fsutil.WriteFile(fs, fpath, 0666, bytes.NewBuffer(b))
+}
@@ -0,0 +1,113 @@
+package forky
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/src-d/go-billy.v4/util"
+)
+
+func TestModuleSave(t *testing.T) {
+	s := NewModuleSession("/src/a", "/dst/z", "example.com/z")
+	s.Observer = NewTextObserver(&bytes.Buffer{})
+	s.fs = newMemFS()
+
+	files := map[string]string{
+		"go.mod": `module example.com/a
+
+go 1.12
+
+require example.com/b v1.0.0
+
+replace example.com/b => ../b
+`,
+		"go.sum":       "example.com/b v1.0.0 h1:abc=\n",
+		"main/main.go": "package main\n\nfunc main() {}\n",
+	}
+	for fpath, contents := range files {
+		if err := util.WriteFile(s.fs, filepath.Join("/src/a", fpath), []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Run(nil); err != nil {
+		t.Fatal(err)
+	}
+	if s.source != "example.com/a" {
+		t.Fatalf("unexpected source %s", s.source)
+	}
+	if s.paths["main"].Path != "example.com/a/main" {
+		t.Fatalf("unexpected path %s", s.paths["main"].Path)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"go.mod": `module example.com/z
+
+go 1.12
+
+require example.com/b v1.0.0
+
+replace example.com/b => ../../src/b
+`,
+		"go.sum":       files["go.sum"],
+		"main/main.go": files["main/main.go"],
+	}
+	for fpath, contents := range expected {
+		found, err := readFile(s.fs, filepath.Join("/dst/z", fpath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(string(found)) != strings.TrimSpace(contents) {
+			t.Fatalf("unexpected contents in %s:\n%s", fpath, string(found))
+		}
+	}
+
+	// relative replacement paths are rewritten for the dir the output is saved to
+	if err := s.SaveTo("/scratch/x/y"); err != nil {
+		t.Fatal(err)
+	}
+	found, err := readFile(s.fs, "/scratch/x/y/go.mod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(found), "replace example.com/b => ../../../src/b\n") {
+		t.Fatalf("unexpected go.mod:\n%s", string(found))
+	}
+}
+
+func TestModuleLibify(t *testing.T) {
+	s := NewModuleSession("/src/a", "/dst/z", "example.com/z")
+	s.Observer = NewTextObserver(&bytes.Buffer{})
+	s.fs = newMemFS()
+
+	files := map[string]string{
+		"go.mod":       "module example.com/a\n\ngo 1.12\n",
+		"main/main.go": `package main; import "example.com/z/b"; func main(){}; func a(){b.B()}`,
+		"b/b.go":       `package b; func B(){a++}; var a = 1`,
+	}
+	for fpath, contents := range files {
+		if err := util.WriteFile(s.fs, filepath.Join("/src/a", fpath), []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Run([]Mutator{Libify{Packages: []string{"main"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := readFile(s.fs, "/dst/z/main/package-state.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(found), `b *b.PackageState`) || !strings.Contains(string(found), `"example.com/z/b"`) {
+		t.Fatalf("unexpected contents in main/package-state.go:\n%s", string(found))
+	}
+}
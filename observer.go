@@ -0,0 +1,155 @@
+package forky
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/dave/dst"
+)
+
+// Observer receives progress and events from a Session. The session serializes calls, so
+// implementations don't need to be safe for concurrent use.
+type Observer interface {
+	// PhaseStart is called when a phase starts. total is the number of items that will be
+	// processed, or 0 if the phase doesn't report progress.
+	PhaseStart(phase string, total int)
+	// Progress is called after each item (a dir or a file) in a phase has been processed.
+	Progress(phase, item string, done, total int)
+	PhaseEnd(phase string)
+	// Changed is called after a mutator has been applied with the number of files it changed or
+	// deleted. It's not called for mutators that only have a Func.
+	Changed(mutator string, files int)
+	Warning(w *Error)
+}
+
+// TextObserver writes progress to a terminal, overwriting the line for each progress update.
+type TextObserver struct {
+	w io.Writer
+}
+
+func NewTextObserver(w io.Writer) *TextObserver {
+	return &TextObserver{w: w}
+}
+
+func (o *TextObserver) PhaseStart(phase string, total int) {
+	fmt.Fprintf(o.w, "\r%s", phase)
+}
+
+func (o *TextObserver) Progress(phase, item string, done, total int) {
+	fmt.Fprintf(o.w, "\r%s: %d/%d", phase, done, total)
+}
+
+func (o *TextObserver) PhaseEnd(phase string) {
+	fmt.Fprintln(o.w)
+}
+
+func (o *TextObserver) Changed(mutator string, files int) {
+	fmt.Fprintf(o.w, "%s: %d files changed\n", mutator, files)
+}
+
+func (o *TextObserver) Warning(w *Error) {
+	fmt.Fprintf(o.w, "warning: %v\n", w)
+}
+
+// JSONObserver writes every event as a line of JSON, e.g.:
+//
+//	{"event":"progress","phase":"Parsing","item":"src/fmt","done":12,"total":340}
+type JSONObserver struct {
+	enc *json.Encoder
+}
+
+func NewJSONObserver(w io.Writer) *JSONObserver {
+	return &JSONObserver{enc: json.NewEncoder(w)}
+}
+
+// Event is the JSON encoding of an observer event.
+type Event struct {
+	Event   string `json:"event"` // phase_start, progress, phase_end, changed or warning
+	Phase   string `json:"phase,omitempty"`
+	Item    string `json:"item,omitempty"`
+	Done    int    `json:"done,omitempty"`
+	Total   int    `json:"total,omitempty"`
+	Mutator string `json:"mutator,omitempty"`
+	Files   int    `json:"files,omitempty"`
+	Pos     string `json:"pos,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func (o *JSONObserver) PhaseStart(phase string, total int) {
+	o.enc.Encode(Event{Event: "phase_start", Phase: phase, Total: total})
+}
+
+func (o *JSONObserver) Progress(phase, item string, done, total int) {
+	o.enc.Encode(Event{Event: "progress", Phase: phase, Item: item, Done: done, Total: total})
+}
+
+func (o *JSONObserver) PhaseEnd(phase string) {
+	o.enc.Encode(Event{Event: "phase_end", Phase: phase})
+}
+
+func (o *JSONObserver) Changed(mutator string, files int) {
+	o.enc.Encode(Event{Event: "changed", Mutator: mutator, Files: files})
+}
+
+func (o *JSONObserver) Warning(w *Error) {
+	e := Event{Event: "warning", Mutator: w.Mutator, Message: w.Err.Error()}
+	if w.Pos.Filename != "" || w.Pos.IsValid() {
+		e.Pos = w.Pos.String()
+	}
+	o.enc.Encode(e)
+}
+
+// observer serializes calls to the session observer, and ignores them if there is no observer.
+type observer struct {
+	sync.Mutex
+	s *Session
+}
+
+func (o *observer) PhaseStart(phase string, total int) {
+	o.Lock()
+	defer o.Unlock()
+	if o.s.Observer != nil {
+		o.s.Observer.PhaseStart(phase, total)
+	}
+}
+
+func (o *observer) Progress(phase, item string, done, total int) {
+	o.Lock()
+	defer o.Unlock()
+	if o.s.Observer != nil {
+		o.s.Observer.Progress(phase, item, done, total)
+	}
+}
+
+func (o *observer) PhaseEnd(phase string) {
+	o.Lock()
+	defer o.Unlock()
+	if o.s.Observer != nil {
+		o.s.Observer.PhaseEnd(phase)
+	}
+}
+
+func (o *observer) Changed(mutator string, files int) {
+	o.Lock()
+	defer o.Unlock()
+	if o.s.Observer != nil {
+		o.s.Observer.Changed(mutator, files)
+	}
+}
+
+func (o *observer) Warning(w *Error) {
+	o.Lock()
+	defer o.Unlock()
+	if o.s.Observer != nil {
+		o.s.Observer.Warning(w)
+	}
+}
+
+// Warnf reports a warning at a node in a file to the observer. It may be called concurrently by
+// appliers. Unlike Errorf, warnings don't cause Run to fail.
+func (s *Session) Warnf(relpath, fname string, node dst.Node, format string, args ...interface{}) {
+	w := &Error{Pos: s.nodePosition(relpath, fname, node), Mutator: s.mutator, Err: fmt.Errorf(format, args...)}
+	s.events.Warning(w)
+}
@@ -0,0 +1,88 @@
+package forky
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/token"
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/dstutil"
+)
+
+func TestJSONObserver(t *testing.T) {
+	s := newTestSession(t, map[string]string{
+		"a/a.go":  "package a\n\nvar A = \"foo\"\n",
+		"a/b.go":  "package a\n\nvar B = \"b\"\n",
+		"a/c.txt": "c\n",
+	})
+	buf := &bytes.Buffer{}
+	s.Observer = NewJSONObserver(buf)
+	err := s.Run([]Mutator{
+		FilterFiles(func(relpath, fname string) bool {
+			return fname != "c.txt"
+		}),
+		ModifyStrings(func(s string) string {
+			if s == "foo" {
+				return "bar"
+			}
+			return s
+		}),
+		Manual(func(relpath, fname string) func(c *dstutil.Cursor) bool {
+			return func(c *dstutil.Cursor) bool {
+				if id, ok := c.Node().(*dst.Ident); ok && id.Name == "B" {
+					s.Warnf(relpath, fname, id, "found %s", id.Name)
+				}
+				return true
+			}
+		}),
+		DeleteNodes(func(relpath, fname string, node, parent dst.Node) bool {
+			decl, ok := node.(*dst.GenDecl)
+			return ok && fname == "b.go" && decl.Tok == token.VAR
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var changed, warnings []Event
+	var progress int
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var e Event
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		switch e.Event {
+		case "changed":
+			changed = append(changed, e)
+		case "warning":
+			warnings = append(warnings, e)
+		case "progress":
+			if e.Phase == "Applying (2/4)" {
+				progress++
+			}
+		}
+	}
+
+	expected := []Event{
+		{Event: "changed", Mutator: "forky.FilterFiles", Files: 1},
+		{Event: "changed", Mutator: "forky.ModifyStrings", Files: 1},
+		{Event: "changed", Mutator: "forky.Manual"},
+		{Event: "changed", Mutator: "forky.DeleteNodes", Files: 1},
+	}
+	if len(changed) != len(expected) {
+		t.Fatalf("expected %d changed events, got %#v", len(expected), changed)
+	}
+	for i := range expected {
+		if changed[i] != expected[i] {
+			t.Fatalf("changed event %d: expected %#v, got %#v", i, expected[i], changed[i])
+		}
+	}
+	if progress != 2 {
+		t.Fatalf("expected 2 progress events, got %d", progress)
+	}
+	if len(warnings) != 1 || warnings[0].Pos != "/a/b.go:3:5" || warnings[0].Mutator != "forky.Manual" || warnings[0].Message != "found B" {
+		t.Fatalf("unexpected warnings %#v", warnings)
+	}
+}
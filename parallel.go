@@ -0,0 +1,44 @@
+package forky
+
+import "sync"
+
+// parallel calls f for every index in [0, n) using a pool of workers. After each call, progress
+// is called with the index and the number of calls completed so far (calls to progress are
+// serialized). If several calls fail, the error with the lowest index is returned, so the result
+// doesn't depend on scheduling.
+func parallel(workers, n int, f func(i int) error, progress func(i, done int)) error {
+	if workers < 1 {
+		workers = 1
+	}
+	errs := make([]error, n)
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var done int
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = f(i)
+				mu.Lock()
+				done++
+				if progress != nil {
+					progress(i, done)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package forky
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParallel(t *testing.T) {
+	results := make([]int, 100)
+	var last int
+	err := parallel(8, len(results), func(i int) error {
+		results[i] = i * 2
+		if i%10 == 3 {
+			return fmt.Errorf("error %d", i)
+		}
+		return nil
+	}, func(i, done int) {
+		if done != last+1 {
+			t.Errorf("progress out of order: %d after %d", done, last)
+		}
+		last = done
+	})
+	if err == nil || err.Error() != "error 3" {
+		t.Fatalf("expected error 3, got %v", err)
+	}
+	if last != len(results) {
+		t.Fatalf("expected %d calls to progress, got %d", len(results), last)
+	}
+	for i, v := range results {
+		if v != i*2 {
+			t.Fatalf("unexpected result %d at %d", v, i)
+		}
+	}
+}
+
+func TestConcurrentApply(t *testing.T) {
+	files := map[string]map[string]string{}
+	expected := map[string]map[string]string{}
+	for i := 0; i < 20; i++ {
+		path := fmt.Sprintf("p%d", i)
+		files[path] = map[string]string{"a.go": `package p; var a = "foo"`, "b.go": `package p; var b = "foo"`}
+		expected[path] = map[string]string{"a.go": `package p; var a = "bar"`, "b.go": `package p; var b = "bar"`}
+	}
+	err := runTest(testspec{
+		files: files,
+		mutators: Concurrent(ModifyStrings(func(s string) string {
+			if s == "foo" {
+				return "bar"
+			}
+			return s
+		})),
+		expected: expected,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,80 @@
+package forky
+
+import (
+	"go/build"
+	"path"
+	"strings"
+
+	"github.com/dave/dst/decorator/resolver"
+	"golang.org/x/tools/go/packages"
+)
+
+// packageResolver resolves the names of the packages imported by the files in a dir of the
+// output. Packages in the session (including vendored packages) are resolved from their parsed
+// package clause, other packages from the type information of the last type check, and then by
+// finding them in GOROOT or GOPATH. The name is only guessed from the path as a last resort.
+type packageResolver struct {
+	s       *Session
+	relpath string
+}
+
+func (r packageResolver) ResolvePackage(importPath string) (string, error) {
+	s := r.s
+	for dir := r.relpath; ; dir = path.Dir(dir) {
+		if name := s.packageName(path.Join(dir, "vendor", importPath)); name != "" {
+			return name, nil
+		}
+		if dir == "." {
+			break
+		}
+	}
+	if relpath, ok := s.Rel(importPath); ok {
+		if name := s.packageName(relpath); name != "" {
+			return name, nil
+		}
+	}
+	if name, ok := s.pkgNames[importPath]; ok {
+		return name, nil
+	}
+	if name := s.buildPackageName(importPath); name != "" {
+		return name, nil
+	}
+	return (&resolver.Guess{}).ResolvePackage(importPath)
+}
+
+// packageName returns the name of the package in a dir of the session, or "" if there isn't one.
+func (s *Session) packageName(relpath string) string {
+	info := s.paths[relpath]
+	if info == nil || info.Default == nil || strings.HasSuffix(info.Default.Name, "_test") {
+		return ""
+	}
+	return info.Default.Name
+}
+
+// buildPackageName finds a package that isn't in the session in GOROOT or GOPATH, and returns its
+// name, or "" if it's not found. Results are cached.
+func (s *Session) buildPackageName(importPath string) string {
+	s.namesm.Lock()
+	defer s.namesm.Unlock()
+	if name, ok := s.buildNames[importPath]; ok {
+		return name
+	}
+	var name string
+	if p, err := build.Import(importPath, "", 0); err == nil {
+		name = p.Name
+	}
+	if s.buildNames == nil {
+		s.buildNames = map[string]string{}
+	}
+	s.buildNames[importPath] = name
+	return name
+}
+
+// packageNames returns the names of the packages loaded by a type check, by path.
+func packageNames(pkgs []*packages.Package) map[string]string {
+	names := map[string]string{}
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		names[pkg.PkgPath] = pkg.Name
+	})
+	return names
+}
@@ -0,0 +1,256 @@
+package forky
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dave/services/fsutil"
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/util"
+)
+
+// ManifestName is the name of the file in the destination that lists the files written by Save.
+const ManifestName = ".forky-manifest"
+
+// Save writes the output to the destination dir. The output is written to a temporary dir next
+// to the destination, which is then swapped in, so the destination is never left half written.
+// Files that were written by a previous Save (they are listed in the manifest) are deleted if
+// they're no longer in the output. Other files in the destination (e.g. the .git dir) are kept,
+// and Save fails if the output would overwrite any of them, unless Force is set.
+func (s *Session) Save() error {
+	destinationDir := s.destinationDir()
+	tempfs, err := s.render("Saving", destinationDir)
+	if err != nil {
+		return err
+	}
+
+	// the temporary dirs mustn't have the destination as a prefix (memfs renames by prefix)
+	parent, base := filepath.Split(destinationDir)
+	newDir := filepath.Join(parent, ".forky-new-"+base)
+	oldDir := filepath.Join(parent, ".forky-old-"+base)
+
+	if err := s.recoverSave(destinationDir, newDir, oldDir); err != nil {
+		return err
+	}
+
+	output, err := listFiles(tempfs, "/")
+	if err != nil {
+		return err
+	}
+	owned, err := readManifest(s.fs, destinationDir)
+	if err != nil {
+		return err
+	}
+
+	// files in the destination that weren't written by forky, and would be overwritten
+	var existing map[string]bool
+	if _, err := s.fs.Stat(destinationDir); err == nil {
+		existing, err = listFiles(s.fs, destinationDir)
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	var conflicts []string
+	for fpath := range existing {
+		if output[fpath] && !owned[fpath] {
+			conflicts = append(conflicts, fpath)
+		}
+	}
+	if len(conflicts) > 0 && !s.Force {
+		sort.Strings(conflicts)
+		return fmt.Errorf("save would overwrite %d files in %s not created by forky (set Force to overwrite them):\n%s", len(conflicts), destinationDir, strings.Join(conflicts, "\n"))
+	}
+
+	if err := fsutil.Copy(s.fs, newDir, tempfs, "/"); err != nil {
+		return err
+	}
+	if err := writeManifest(s.fs, newDir, output); err != nil {
+		return err
+	}
+
+	if existing == nil {
+		if err := s.fs.MkdirAll(parent, 0777); err != nil {
+			return err
+		}
+		return s.fs.Rename(newDir, destinationDir)
+	}
+
+	// Move the files we don't own to the new dir. If this is interrupted, the next Save moves them
+	// back (files in the new dir that aren't in its manifest).
+	if err := moveUnowned(s.fs, destinationDir, newDir, "", owned); err != nil {
+		return err
+	}
+	if err := s.fs.Rename(destinationDir, oldDir); err != nil {
+		return err
+	}
+	if err := s.fs.Rename(newDir, destinationDir); err != nil {
+		return err
+	}
+	return util.RemoveAll(s.fs, oldDir)
+}
+
+// SaveTo writes the output to dir, e.g. a scratch dir to build or test the output in. Unlike Save,
+// files in dir are overwritten, and no manifest is written.
+func (s *Session) SaveTo(dir string) error {
+	tempfs, err := s.render("Saving", dir)
+	if err != nil {
+		return err
+	}
+	return fsutil.Copy(s.fs, dir, tempfs, "/")
+}
+
+// destinationDir returns the dir Save writes the output to.
+func (s *Session) destinationDir() string {
+	if s.outdir != "" {
+		return filepath.Clean(s.outdir)
+	}
+	return filepath.Join(s.gopathsrc, s.destination)
+}
+
+// recoverSave cleans up after a Save that was interrupted.
+func (s *Session) recoverSave(destinationDir, newDir, oldDir string) error {
+	if _, err := s.fs.Stat(newDir); err == nil {
+		_, err := s.fs.Stat(filepath.Join(newDir, ManifestName))
+		complete := err == nil
+		_, err = s.fs.Stat(destinationDir)
+		switch {
+		case !complete:
+			// interrupted while writing the new dir (the manifest is written last): nothing has been
+			// moved out of the destination yet
+			if err := util.RemoveAll(s.fs, newDir); err != nil {
+				return err
+			}
+		case os.IsNotExist(err):
+			// interrupted between the renames: the new dir is complete
+			if err := s.fs.Rename(newDir, destinationDir); err != nil {
+				return err
+			}
+		default:
+			// interrupted before the swap: move back any files that had been moved to the new dir
+			owned, err := readManifest(s.fs, newDir)
+			if err != nil {
+				return err
+			}
+			if err := moveUnowned(s.fs, newDir, destinationDir, "", owned); err != nil {
+				return err
+			}
+			if err := util.RemoveAll(s.fs, newDir); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := s.fs.Stat(oldDir); err == nil {
+		if err := util.RemoveAll(s.fs, oldDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveUnowned moves the files in from/dir that aren't in owned to the same place in to. Dirs that
+// don't contain owned files and don't exist in to are moved in one go. Files that exist in to are
+// not moved.
+func moveUnowned(fs billy.Filesystem, from, to, dir string, owned map[string]bool) error {
+	fis, err := fs.ReadDir(filepath.Join(from, dir))
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		rel := filepath.Join(dir, fi.Name())
+		if rel == ManifestName || owned[rel] {
+			continue
+		}
+		_, err := fs.Stat(filepath.Join(to, rel))
+		exists := err == nil
+		if fi.IsDir() && (exists || ownsDir(owned, rel)) {
+			if err := moveUnowned(fs, from, to, rel, owned); err != nil {
+				return err
+			}
+			continue
+		}
+		if exists {
+			continue
+		}
+		if err := fs.MkdirAll(filepath.Join(to, dir), 0777); err != nil {
+			return err
+		}
+		if err := fs.Rename(filepath.Join(from, rel), filepath.Join(to, rel)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ownsDir(owned map[string]bool, dir string) bool {
+	for fpath := range owned {
+		if strings.HasPrefix(fpath, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// listFiles returns the paths of all files in dir, relative to dir.
+func listFiles(fs billy.Filesystem, dir string) (map[string]bool, error) {
+	files := map[string]bool{}
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		fis, err := fs.ReadDir(filepath.Join(dir, rel))
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			if fi.IsDir() {
+				if err := walk(filepath.Join(rel, fi.Name())); err != nil {
+					return err
+				}
+				continue
+			}
+			files[filepath.Join(rel, fi.Name())] = true
+		}
+		return nil
+	}
+	if err := walk(""); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// readManifest returns the files listed in the manifest in dir. If there's no manifest, no files
+// are owned.
+func readManifest(fs billy.Filesystem, dir string) (map[string]bool, error) {
+	owned := map[string]bool{}
+	b, err := readFile(fs, filepath.Join(dir, ManifestName))
+	if os.IsNotExist(err) {
+		return owned, nil
+	} else if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			owned[filepath.FromSlash(line)] = true
+		}
+	}
+	return owned, scanner.Err()
+}
+
+func writeManifest(fs billy.Filesystem, dir string, files map[string]bool) error {
+	var lines []string
+	for fpath := range files {
+		lines = append(lines, filepath.ToSlash(fpath))
+	}
+	sort.Strings(lines)
+	buf := &bytes.Buffer{}
+	for _, line := range lines {
+		fmt.Fprintln(buf, line)
+	}
+	return util.WriteFile(fs, filepath.Join(dir, ManifestName), buf.Bytes(), 0666)
+}
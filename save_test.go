@@ -0,0 +1,157 @@
+package forky
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+)
+
+func TestSave(t *testing.T) {
+	fs := newMemFS()
+	write := func(fpath, contents string) {
+		if err := util.WriteFile(fs, fpath, []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save := func(force bool) error {
+		s := NewSession("/src", "", "")
+		s.Observer = NewTextObserver(&bytes.Buffer{})
+		s.gopathsrc = "/"
+		s.fs = fs
+		s.outdir = "/out"
+		s.Force = force
+		if err := s.Run(nil); err != nil {
+			t.Fatal(err)
+		}
+		return s.Save()
+	}
+	check := func(fpath, expected string) {
+		t.Helper()
+		found, err := readFile(fs, fpath)
+		if expected == "" {
+			if err == nil {
+				t.Fatalf("%s should not exist", fpath)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(found) != expected {
+			t.Fatalf("unexpected contents in %s: %q", fpath, string(found))
+		}
+	}
+
+	write("/src/a/a.go", "package a\n")
+	write("/src/a/b/b.go", "package b\n")
+	write("/out/.git/HEAD", "ref: refs/heads/master\n")
+	write("/out/a/notes.txt", "notes\n")
+
+	if err := save(false); err != nil {
+		t.Fatal(err)
+	}
+	check("/out/a/a.go", "package a\n")
+	check("/out/a/b/b.go", "package b\n")
+	check("/out/.git/HEAD", "ref: refs/heads/master\n")
+	check("/out/a/notes.txt", "notes\n")
+	check("/out/"+ManifestName, "a/a.go\na/b/b.go\n")
+
+	// stale files written by the last save are deleted, other files are kept
+	if err := fs.Remove("/src/a/b/b.go"); err != nil {
+		t.Fatal(err)
+	}
+	write("/out/a/b/c.txt", "c\n")
+	if err := save(false); err != nil {
+		t.Fatal(err)
+	}
+	check("/out/a/b/b.go", "")
+	check("/out/a/b/c.txt", "c\n")
+	check("/out/.git/HEAD", "ref: refs/heads/master\n")
+	check("/out/"+ManifestName, "a/a.go\n")
+
+	// files not created by forky are only overwritten with Force
+	write("/src/a/notes.txt", "new notes\n")
+	err := save(false)
+	if err == nil || !strings.Contains(err.Error(), "a/notes.txt") {
+		t.Fatalf("expected error, got %v", err)
+	}
+	check("/out/a/notes.txt", "notes\n")
+	if err := save(true); err != nil {
+		t.Fatal(err)
+	}
+	check("/out/a/notes.txt", "new notes\n")
+	check("/out/"+ManifestName, "a/a.go\na/notes.txt\n")
+
+	// a save interrupted while moving files to the new dir is rolled back
+	write("/.forky-new-out/"+ManifestName, "a/a.go\n")
+	write("/.forky-new-out/a/a.go", "package a\n")
+	if err := fs.Rename("/out/.git", "/.forky-new-out/.git"); err != nil {
+		t.Fatal(err)
+	}
+	if err := save(false); err != nil {
+		t.Fatal(err)
+	}
+	check("/out/.git/HEAD", "ref: refs/heads/master\n")
+	if _, err := fs.Stat("/.forky-new-out"); err == nil {
+		t.Fatal("new dir should be removed")
+	}
+
+	// a save interrupted while copying the output to the new dir (there's no manifest yet) is
+	// discarded, whether or not the destination exists
+	write("/.forky-new-out/a/partial.go", "package a\n")
+	if err := save(false); err != nil {
+		t.Fatal(err)
+	}
+	check("/out/a/partial.go", "")
+	check("/out/.git/HEAD", "ref: refs/heads/master\n")
+	if err := fs.Rename("/out", "/prev"); err != nil {
+		t.Fatal(err)
+	}
+	write("/.forky-new-out/a/partial.go", "package a\n")
+	if err := save(false); err != nil {
+		t.Fatal(err)
+	}
+	check("/out/a/partial.go", "")
+	check("/out/a/a.go", "package a\n")
+	if _, err := fs.Stat("/.forky-new-out"); err == nil {
+		t.Fatal("new dir should be removed")
+	}
+}
+
+// memFS is a memfs that can rename dirs. memfs loses files when a dir that contains dirs is
+// renamed.
+type memFS struct {
+	billy.Filesystem
+}
+
+func newMemFS() billy.Filesystem {
+	return memFS{memfs.New()}
+}
+
+func (fs memFS) Rename(from, to string) error {
+	fi, err := fs.Stat(from)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fs.Filesystem.Rename(from, to)
+	}
+	files, err := listFiles(fs, from)
+	if err != nil {
+		return err
+	}
+	for fpath := range files {
+		if err := fs.MkdirAll(filepath.Dir(filepath.Join(to, fpath)), 0777); err != nil {
+			return err
+		}
+		if err := fs.Filesystem.Rename(filepath.Join(from, fpath), filepath.Join(to, fpath)); err != nil {
+			return err
+		}
+	}
+	return util.RemoveAll(fs.Filesystem, from)
+}
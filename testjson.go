@@ -0,0 +1,171 @@
+package forky
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TestEvent is an event in the output of go test -json.
+type TestEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Output  string
+}
+
+// TestFailures reads the output of go test -json run on the saved output, and returns a TestSkip
+// for each failed test with the first line of its failure message as the comment. Only the
+// innermost failed subtests are returned (their parents fail too). Package paths are converted to
+// relpaths. The relpaths of packages that failed without a failing test (e.g. because they didn't
+// build) are returned in packages.
+func (s *Session) TestFailures(r io.Reader) (skips []TestSkip, packages []string, err error) {
+	type test struct{ path, name string }
+	output := map[test][]string{}
+	var failed []test
+	failedPackages := map[string]bool{}
+	packageTests := map[string]bool{} // packages with a failed test
+	dec := json.NewDecoder(r)
+	for dec.More() {
+		var e TestEvent
+		if err := dec.Decode(&e); err != nil {
+			return nil, nil, err
+		}
+		t := test{s.testRelpath(e.Package), e.Test}
+		switch e.Action {
+		case "output":
+			if e.Test != "" {
+				output[t] = append(output[t], e.Output)
+			}
+		case "fail":
+			if e.Test == "" {
+				failedPackages[t.path] = true
+			} else {
+				failed = append(failed, t)
+				packageTests[t.path] = true
+			}
+		}
+	}
+	for _, t := range failed {
+		var parent bool
+		for _, other := range failed {
+			if other.path == t.path && strings.HasPrefix(other.name, t.name+"/") {
+				parent = true
+				break
+			}
+		}
+		if parent {
+			continue
+		}
+		skips = append(skips, TestSkip{Path: t.path, Name: t.name, Comment: failureMessage(output[t])})
+	}
+	sort.SliceStable(skips, func(i, j int) bool {
+		if skips[i].Path != skips[j].Path {
+			return skips[i].Path < skips[j].Path
+		}
+		return skips[i].Name < skips[j].Name
+	})
+	for relpath := range failedPackages {
+		if !packageTests[relpath] {
+			packages = append(packages, relpath)
+		}
+	}
+	sort.Strings(packages)
+	return skips, packages, nil
+}
+
+// testRelpath returns the relpath of a package in the destination.
+func (s *Session) testRelpath(pkgpath string) string {
+	if pkgpath == s.destination {
+		return "."
+	}
+	return strings.TrimPrefix(pkgpath, s.destination+"/")
+}
+
+// failureMessage returns the first line of output of a test that isn't written by go test itself.
+func failureMessage(lines []string) string {
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "=== ") || strings.HasPrefix(line, "--- ") {
+			continue
+		}
+		return line
+	}
+	return "failed"
+}
+
+// DiffTestSkips compares the failures of a test run to an existing list of skips, and returns the
+// failures that no existing skip matches, and the existing skips that match no failure. A skip of a
+// test matches the failures of its subtests.
+func DiffTestSkips(existing, failures []TestSkip) (added, stale []TestSkip, err error) {
+	matchers := make([]testMatcher, len(existing))
+	for i, ts := range existing {
+		if matchers[i], err = newTestMatcher(ts); err != nil {
+			return nil, nil, err
+		}
+	}
+	used := make([]bool, len(existing))
+	for _, f := range failures {
+		var found bool
+		for i, tm := range matchers {
+			if tm.matchPath(f.Path) && matchTestOrParent(tm, f.Name) {
+				used[i] = true
+				found = true
+			}
+		}
+		if !found {
+			added = append(added, f)
+		}
+	}
+	for i, ts := range existing {
+		if !used[i] {
+			stale = append(stale, ts)
+		}
+	}
+	return added, stale, nil
+}
+
+// matchTestOrParent returns true if a skip matches a test, or one of the tests that run it (e.g.
+// TestA and TestA/b for TestA/b/c).
+func matchTestOrParent(tm testMatcher, name string) bool {
+	for {
+		if tm.matchName(name) {
+			return true
+		}
+		i := strings.LastIndex(name, "/")
+		if i < 0 {
+			return false
+		}
+		name = name[:i]
+	}
+}
+
+// WriteTestSkips writes a list of skips as Go source (a forky.TestSkipper literal) if format is
+// "go", or as a skip_tests item of a config mutators list if format is "yaml".
+func WriteTestSkips(w io.Writer, skips []TestSkip, format string) error {
+	var lines []string
+	switch format {
+	case "go":
+		lines = append(lines, "forky.TestSkipper{")
+		for _, ts := range skips {
+			lines = append(lines, fmt.Sprintf("\t{Path: %s, Name: %s, Comment: %s},", strconv.Quote(ts.Path), strconv.Quote(ts.Name), strconv.Quote(ts.Comment)))
+		}
+		lines = append(lines, "}")
+	case "yaml":
+		if len(skips) == 0 {
+			lines = append(lines, "- skip_tests: []")
+			break
+		}
+		lines = append(lines, "- skip_tests:")
+		for _, ts := range skips {
+			lines = append(lines, fmt.Sprintf("    - {path: %s, name: %s, comment: %s}", strconv.Quote(ts.Path), strconv.Quote(ts.Name), strconv.Quote(ts.Comment)))
+		}
+	default:
+		return fmt.Errorf("unknown format %q (expected go or yaml)", format)
+	}
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
@@ -0,0 +1,97 @@
+package forky
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestTestFailures(t *testing.T) {
+	events := `{"Action":"run","Package":"b.com/x/a","Test":"TestA"}
+{"Action":"output","Package":"b.com/x/a","Test":"TestA","Output":"=== RUN   TestA\n"}
+{"Action":"output","Package":"b.com/x/a","Test":"TestA","Output":"--- FAIL: TestA (0.00s)\n"}
+{"Action":"output","Package":"b.com/x/a","Test":"TestA","Output":"    a_test.go:5: expected 1, found 2\n"}
+{"Action":"fail","Package":"b.com/x/a","Test":"TestA"}
+{"Action":"output","Package":"b.com/x/a","Test":"TestB","Output":"=== RUN   TestB\n"}
+{"Action":"pass","Package":"b.com/x/a","Test":"TestB"}
+{"Action":"output","Package":"b.com/x/a","Test":"TestC/sub","Output":"    a_test.go:9: sub failed\n"}
+{"Action":"fail","Package":"b.com/x/a","Test":"TestC/sub"}
+{"Action":"fail","Package":"b.com/x/a","Test":"TestC"}
+{"Action":"fail","Package":"b.com/x/a"}
+{"Action":"output","Package":"b.com/x","Output":"# b.com/x\n"}
+{"Action":"fail","Package":"b.com/x"}
+{"Action":"fail","Package":"b.com/x/b","Test":"TestD"}
+{"Action":"fail","Package":"b.com/x/b"}
+`
+	s := NewSession("/", "a.com/x", "b.com/x")
+	failures, packages, err := s.TestFailures(strings.NewReader(events))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []TestSkip{
+		{Path: "a", Name: "TestA", Comment: "a_test.go:5: expected 1, found 2"},
+		{Path: "a", Name: "TestC/sub", Comment: "a_test.go:9: sub failed"},
+		{Path: "b", Name: "TestD", Comment: "failed"},
+	}
+	if !reflect.DeepEqual(failures, expected) {
+		t.Fatalf("expected %v, found %v", expected, failures)
+	}
+	if !reflect.DeepEqual(packages, []string{"."}) {
+		t.Fatalf("expected failed package ., found %v", packages)
+	}
+
+	existing := []TestSkip{
+		{Path: "a", Name: "TestA"},
+		{Path: "b", Name: "Test.*", Regexp: true},
+		{Path: "a", Name: "TestE"},
+	}
+	added, stale, err := DiffTestSkips(existing, failures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(added, expected[1:2]) {
+		t.Fatalf("expected added %v, found %v", expected[1:2], added)
+	}
+	if !reflect.DeepEqual(stale, existing[2:]) {
+		t.Fatalf("expected stale %v, found %v", existing[2:], stale)
+	}
+
+	// a skip of a parent test covers the failures of its subtests
+	added, stale, err = DiffTestSkips(append(existing[:2:2], TestSkip{Path: "a", Name: "TestC"}), failures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 0 || len(stale) != 0 {
+		t.Fatalf("expected no changes, found added %v, stale %v", added, stale)
+	}
+
+	formats := map[string]string{
+		"go":   "forky.TestSkipper{\n\t{Path: \"a\", Name: \"TestA\", Comment: \"a_test.go:5: expected 1, found 2\"},\n}\n",
+		"yaml": "- skip_tests:\n    - {path: \"a\", name: \"TestA\", comment: \"a_test.go:5: expected 1, found 2\"}\n",
+	}
+	for format, contents := range formats {
+		buf := &bytes.Buffer{}
+		if err := WriteTestSkips(buf, expected[:1], format); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != contents {
+			t.Fatalf("%s: expected %q, found %q", format, contents, buf.String())
+		}
+	}
+
+	// the yaml output is a valid mutators list
+	buf := &bytes.Buffer{}
+	if err := WriteTestSkips(buf, expected, "yaml"); err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(buf.Bytes(), &c.Mutators); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Mutators) != 1 || len(c.Mutators[0].SkipTests) != len(expected) || c.Mutators[0].SkipTests[1].Name != "TestC/sub" {
+		t.Fatalf("unexpected config %#v", c.Mutators)
+	}
+}
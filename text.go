@@ -0,0 +1,85 @@
+package forky
+
+import (
+	"bytes"
+	"path/filepath"
+	"sort"
+)
+
+// ModifyText is a mutator for the contents of extras: files that are not parsed as Go (assembly,
+// testdata, go files excluded by ParseFilter etc.). Return keep == false to delete the file. In
+// module mode, the root go.mod is rewritten by the session and is not visited.
+type ModifyText func(relpath, fname string, contents []byte) (result []byte, keep bool)
+
+func (m ModifyText) Apply(s *Session) Applier {
+	return Applier{
+		ApplyText: m,
+	}
+}
+
+// applyText runs the text function of an applier on every extras file, and returns the number of
+// files that were changed or deleted.
+func (s *Session) applyText(applier Applier, phase string) (int, error) {
+	type job struct {
+		info  *PathInfo
+		fname string
+	}
+	var jobs []job
+	for _, relpath := range s.relpaths() {
+		info := s.paths[relpath]
+		var fnames []string
+		for fname := range info.Extras {
+			if s.modfile != nil && relpath == "." && fname == "go.mod" {
+				continue
+			}
+			fnames = append(fnames, fname)
+		}
+		sort.Strings(fnames)
+		for _, fname := range fnames {
+			jobs = append(jobs, job{info: info, fname: fname})
+		}
+	}
+
+	workers := 1
+	if applier.Concurrent {
+		workers = s.Workers
+	}
+
+	results := make([][]byte, len(jobs))
+	keep := make([]bool, len(jobs))
+	changed := make([]bool, len(jobs))
+	s.events.PhaseStart(phase, len(jobs))
+	if err := parallel(workers, len(jobs), func(i int) error {
+		j := jobs[i]
+		b, ok := j.info.Contents[j.fname]
+		if !ok {
+			var err error
+			if b, err = readFile(s.srcFS(), filepath.Join(s.dir, j.info.Relpath, j.fname)); err != nil {
+				return err
+			}
+		}
+		results[i], keep[i] = applier.ApplyText(j.info.Relpath, j.fname, b)
+		changed[i] = !keep[i] || !bytes.Equal(b, results[i])
+		return nil
+	}, func(i, done int) {
+		s.events.Progress(phase, filepath.Join(jobs[i].info.Relpath, jobs[i].fname), done, len(jobs))
+	}); err != nil {
+		return 0, err
+	}
+	s.events.PhaseEnd(phase)
+
+	var count int
+	for i, j := range jobs {
+		if !changed[i] {
+			continue
+		}
+		count++
+		if !keep[i] {
+			delete(j.info.Extras, j.fname)
+			delete(j.info.Contents, j.fname)
+			continue
+		}
+		j.info.Contents[j.fname] = results[i]
+	}
+	return count, nil
+}
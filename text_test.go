@@ -0,0 +1,59 @@
+package forky
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestText(t *testing.T) {
+	files := map[string]string{
+		"a/a.go":            "package a\n\nvar s = \"foo/bar\"\n",
+		"a/a_amd64.s":       "// foo/bar/baz.s\nTEXT ·f(SB),0,$0\n",
+		"a/testdata/t.go":   "package t\n\nimport \"foo/bar\"\n",
+		"a/testdata/t.txt":  "foo/bar\n",
+		"a/testdata/delete": "delete me\n",
+	}
+	s := newTestSession(t, files)
+	s.ParseFilter = func(relpath string, file os.FileInfo) bool {
+		return !strings.Contains(relpath, "testdata")
+	}
+	err := s.Run([]Mutator{
+		&PathReplacer{
+			Matchers:    []string{"foo/bar"},
+			Replacement: "${1}qux/${2}${3}",
+			Extras: func(relpath, fname string) bool {
+				return strings.HasSuffix(fname, ".go") || strings.HasSuffix(fname, ".s")
+			},
+		},
+		ModifyText(func(relpath, fname string, contents []byte) ([]byte, bool) {
+			return contents, fname != "delete"
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"a/a.go":           "package a\n\nvar s = \"qux/foo/bar\"\n",
+		"a/a_amd64.s":      "// qux/foo/bar/baz.s\nTEXT ·f(SB),0,$0\n",
+		"a/testdata/t.go":  "package t\n\nimport \"qux/foo/bar\"\n",
+		"a/testdata/t.txt": "foo/bar\n",
+	}
+	for fpath, contents := range expected {
+		found, err := readFile(s.fs, filepath.Join("/out", fpath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(found) != contents {
+			t.Fatalf("unexpected contents in %s:\n%s", fpath, string(found))
+		}
+	}
+	if _, err := s.fs.Stat("/out/a/testdata/delete"); err == nil {
+		t.Fatal("a/testdata/delete should be deleted")
+	}
+}
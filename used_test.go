@@ -175,8 +175,8 @@ type usedspec struct {
 }
 
 func runUsedTest(spec usedspec) error {
-	s := NewSession("", "")
-	s.out = &bytes.Buffer{}
+	s := NewSession("/", "", "")
+	s.Observer = NewTextObserver(&bytes.Buffer{})
 	s.gopathsrc = "/"
 	s.fs = memfs.New()
 
@@ -197,9 +197,11 @@ func runUsedTest(spec usedspec) error {
 		return err
 	}
 
-	l := NewLibifier(Libify{[]string{"main"}}, s)
+	l := NewLibifier(Libify{Packages: []string{"main"}}, s)
 
-	l.session.load()
+	if err := l.load(Platform{}); err != nil {
+		return err
+	}
 
 	if err := l.scanDeps(); err != nil {
 		return err